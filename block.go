@@ -2,13 +2,14 @@ package main
 
 import (
 	"bytes"
-	"container/list"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
-	"net/http"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	// "io/ioutil"
@@ -137,7 +138,6 @@ var blocks map[uint64]*RespBlockWithKey
 var mu sync.Mutex
 var hashPowerItem map[int64]uint64
 var genBlockNum uint64
-var confirmedBlockNum uint64
 var blockFlag int
 var secp256k1_Context *Context
 
@@ -147,8 +147,6 @@ type HashRateElem struct {
 	Time     uint64
 }
 
-var recentBlockQueue *list.List
-
 func init() {
 	ctx, err := ContextCreate(ContextSign)
 	if err != nil {
@@ -159,7 +157,6 @@ func init() {
 	blocks = make(map[uint64]*RespBlockWithKey)
 	rand.Seed(time.Now().UnixNano())
 	hashPowerItem = make(map[int64]uint64)
-	recentBlockQueue = list.New()
 
 	// ContextDestroy(ctx)
 }
@@ -190,11 +187,12 @@ func unsafeComputeHashrate() (uint64, uint64, uint64, float64) {
 		count++
 	}
 
+	accepted, orphaned := totalConfirmCounts()
 	var rate float64
-	if genBlockNum == 0 {
+	if accepted+orphaned == 0 {
 		rate = 0.0
 	} else {
-		rate = (float64(confirmedBlockNum) / float64(genBlockNum)) * 100.0
+		rate = (float64(accepted) / float64(accepted+orphaned)) * 100.0
 	}
 
 	var hashRate uint64
@@ -204,23 +202,26 @@ func unsafeComputeHashrate() (uint64, uint64, uint64, float64) {
 		hashRate = 0
 	}
 
-	return hashRate, genBlockNum, confirmedBlockNum, rate
+	return hashRate, genBlockNum, accepted, rate
 }
 
 func showHashPower() {
 	mu.Lock()
-	hashRate, genBlockNum, confirmedBlockNum, confirmationRate := unsafeComputeHashrate()
+	hashRate, genBlockNum, acceptedNum, confirmationRate := unsafeComputeHashrate()
 	mu.Unlock()
 
-	fmt.Printf("hashrate=%d, candidates=%d, confirmed=%d (%.1f%%)\n", hashRate, genBlockNum, confirmedBlockNum, confirmationRate)
+	fmt.Printf("hashrate=%d, candidates=%d, accepted=%d (%.1f%% of decided)\n", hashRate, genBlockNum, acceptedNum, confirmationRate)
 
-	for _, c := range conf.Chains {
-		val := getDataFromServer(c, conf.Servers[0], "", "statMining", userAddrStr)
-		var count uint64
-		if len(val) > 0 {
-			Decode(val, &count)
+	for _, c := range activeChains() {
+		accepted, orphaned, pending := confirmCounts(c)
+		fmt.Printf("chain:%d, accepted:%d orphaned:%d pending:%d\n", c, accepted, orphaned, pending)
+		var stat MiningStat
+		err := getCoreData(context.Background(), NewNodeClient(conf.Servers[0]), c, "statMining", userAddrStr, &stat)
+		if err != nil && err != ErrNotFound {
+			fmt.Printf("chain:%d, fail to get mining stat: %v\n", c, err)
+			continue
 		}
-		fmt.Printf("chain:%d, successful mining blocks:%d\n", c, count)
+		fmt.Printf("chain:%d, successful mining blocks:%d\n", c, stat.Blocks)
 	}
 }
 
@@ -229,57 +230,100 @@ type wsHead struct {
 	Time int64
 }
 
-func requestBlock(chain uint64, servers chan string) {
-	server := <-servers
-	defer func(s string) {
-		err := recover()
-		if err != nil {
-			log.Println("recover:request block,", err)
+// requestBlock receive jobs from the server until the connection breaks or ctx is done.
+// connected reports whether the handshake succeeded.
+func requestBlock(ctx context.Context, chain uint64, server string, slot *connSlot) (connected bool, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Println("recover:request block,", e)
+			err = fmt.Errorf("panic: %v", e)
 		}
-		servers <- s
-		time.Sleep(time.Second * 5)
-		log.Printf("chain:%d, disconnected from server: %s\n", chain, server)
-		go requestBlock(chain, servers)
-	}(server)
-
-	origin := fmt.Sprintf("http://%s", server)
-	url := fmt.Sprintf("ws://%s/api/v1/%d/ws/mining", server, chain)
-	ws, err := websocket.Dial(url, "", origin)
+	}()
+
+	sampleClock(ctx, chain, server)
+	ws, conn, err := NewNodeClient(server).DialMining(ctx, chain)
 	if err != nil {
-		log.Println("Failed to connect to a server: ", server, err)
-		return
+		recordConnect(server, err)
+		return false, err
 	}
 	defer ws.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ws.Close()
+		case <-done:
+		}
+	}()
 
 	head := wsHead{}
 	// priv1 := wallet.NewPrivateKey()
 	//pub1 := wallet.GetPublicKey(priv1)
 	Decode(userAddress, &head.Addr)
-	head.Time = time.Now().Unix()
+	head.Time = serverNow(server).Unix()
 	data := Encode(head)
 	sign := wallet.Sign(userKey, data)
 	data = append(data, sign...)
 	_, err = ws.Write(data)
 	if err != nil {
 		log.Println("send msg error:", err)
-		return
+		recordConnect(server, err)
+		return false, err
 	}
+	recordConnect(server, nil)
+	var halfOpen int32
+	go keepalive(ws, conn, done, &halfOpen)
 	fmt.Printf("chain:%d, connected to a server: %s\n", chain, server)
+	slot.set(server, connConnected)
+	mu.Lock()
+	unsafeSetConnected(chain, server, true)
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		unsafeSetConnected(chain, server, false)
+		unsafeDropTip(chain, server)
+		mu.Unlock()
+	}()
+	connected = true
+	since := time.Now()
 
+	var malformed int
 	for {
-		t := time.Now().Add(time.Minute * 2)
-		ws.SetReadDeadline(t)
-
 		var blockRaw RespBlock
 		err = websocket.JSON.Receive(ws, &blockRaw)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// the read deadline of keepalive passed
+			atomic.StoreInt32(&halfOpen, 1)
+		}
+		if atomic.LoadInt32(&halfOpen) != 0 {
+			recordConnect(server, errHalfOpen)
+			return true, errHalfOpen
+		}
+		if isMalformedJSON(err) {
+			// the frame was read whole, the connection itself is fine
+			malformed++
+			log.Printf("chain:%d, malformed job from %s: %v\n", chain, server, err)
+			if malformed >= maxMalformedJobs {
+				return true, fmt.Errorf("too many malformed jobs: %v", err)
+			}
+			continue
+		}
 		if err != nil {
-			break
+			return true, err
+		}
+		malformed = 0
+		recordJobTime(server, blockRaw.Time)
+		if reason := checkJob(chain, server, &blockRaw); reason != "" {
+			log.Printf("chain:%d, ignore job from %s: %s\n", chain, server, reason)
+			continue
 		}
 
 		var block RespBlockWithKey
 		block.Block = blockRaw.Block
 		block.HashpowerLimit = blockRaw.HashpowerLimit
 		block.From = server
+		recordJob(chain, server, block.Index)
 
 		// Decide on the account to use:
 		if block.Index%4 == 0 {
@@ -293,84 +337,54 @@ func requestBlock(chain uint64, servers chan string) {
 		}
 
 		mu.Lock()
-		if blocks[block.Chain] == nil || blocks[block.Chain].Index < block.Index {
-			blocks[block.Chain] = &block
-			blockFlag++
-
-			confirmed := false
-			for e := recentBlockQueue.Front(); e != nil; e = e.Next() {
-				value := e.Value.([]byte)
-				if bytes.Equal(value, block.Previous[0:len(block.Previous)]) {
-					confirmed = true
-				}
-			}
+		unsafeSetTip(chain, server, &block)
+		unsafeUpdateJob(chain)
+		mu.Unlock()
 
-			var msg string
-			if confirmed {
-				confirmedBlockNum += 1
-				msg = "(CONFIRMED)"
-			} else {
-				msg = ""
-			}
-			if conf.Verbosity >= 3 {
-				hashRate, genBlockNum, confirmedBlockNum, confirmationRate := unsafeComputeHashrate()
-				log.Printf("new_block hr=%d, cc=%d, cf=%d (%.1f%%) from:%s chain:%d index:%d hpl:%d previous:%x...  %s\n",
-					hashRate, genBlockNum, confirmedBlockNum, confirmationRate,
-					block.From, block.Chain, block.Index, block.HashpowerLimit, block.Previous[:8], msg)
-			}
+		if time.Since(since) > 10*time.Minute && betterServerIdle(chain, server) {
+			return true, fmt.Errorf("leaving for a better scored server")
 		}
-		mu.Unlock()
 	}
 }
 
-func postBlock(chain uint64, server string, key, data []byte) {
-	broadcast := "true"
-	urlStr := fmt.Sprintf("http://%s/api/v1/%d/data?key=%x&broadcast=%s", server, chain, key, broadcast)
-	req, err := http.NewRequest(http.MethodPost, urlStr, bytes.NewBuffer(data))
-	if err != nil {
-		log.Println("Failed to create a new request: ", err)
-		return
-	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Println("Failed to make a requst: ", err)
-		return
+const maxMalformedJobs = 3
+
+func isMalformedJSON(err error) bool {
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return true
 	}
+	return false
+}
 
-	if conf.Verbosity >= 4 {
-		log.Printf("Response status from %s: %s", server, resp.Status)
+// checkJob the reason to refuse a job of the server, "" if it can be mined
+func checkJob(chain uint64, server string, job *RespBlock) string {
+	switch {
+	case job.Chain != chain:
+		return fmt.Sprintf("job of chain %d", job.Chain)
+	case job.Index == 0:
+		return "job without index"
+	case job.HashpowerLimit == 0:
+		return "job without hash power limit"
+	case conf.MaxJobAgeSec > 0 && job.Time > 0:
+		age := serverNow(server).Sub(time.Unix(0, int64(job.Time)*int64(time.Millisecond)))
+		if age > time.Duration(conf.MaxJobAgeSec)*time.Second {
+			return fmt.Sprintf("stale job, %s old", age.Round(time.Second))
+		}
 	}
-	resp.Body.Close()
+	return ""
 }
 
 func updateBlock() {
-	for _, c := range conf.Chains {
-		servers := make(chan string, len(conf.Servers))
-		for _, server := range conf.Servers {
-			servers <- server
-		}
-		for i := 0; i < conf.KeepConnServerNum; i++ {
-			go requestBlock(c, servers)
-		}
+	for _, c := range activeChains() {
+		startSupervisor(c)
 	}
+	go watchTips()
 }
 
 func doMining() {
-	for _, chain := range conf.Chains {
-		for i := 0; i < conf.ThreadNumber; i++ {
-			go func(c uint64, thread int) {
-				for {
-					mu.Lock()
-					block := blocks[c]
-					mu.Unlock()
-					if block == nil {
-						time.Sleep(1 * time.Second)
-						continue
-					}
-					miner(thread, block)
-				}
-			}(chain, i)
-		}
+	for _, chain := range activeChains() {
+		startMiners(chain)
 	}
 }
 
@@ -406,7 +420,8 @@ func miner(thread int, in *RespBlockWithKey) {
 		if oldFlag != blockFlag {
 			mu.Lock()
 
-			if blocks[block.Chain] != nil && blocks[block.Chain].Index != block.Index {
+			// a new job, or the chain is no longer mined
+			if blocks[block.Chain] != in || pausedChains[block.Chain] != "" {
 				now := time.Now().Unix()
 				id := now / 60
 				hashPowerItem[id] += count
@@ -477,14 +492,13 @@ func miner(thread int, in *RespBlockWithKey) {
 
 			if !block.Dev {
 				genBlockNum++
-				if recentBlockQueue.Len() >= 10 {
-					recentBlockQueue.Remove(recentBlockQueue.Front())
-				}
-				recentBlockQueue.PushBack(key)
 			}
 			mu.Unlock()
+			if !block.Dev {
+				trackBlock(block.Chain, block.Index, key)
+			}
 
-			postBlock(block.Chain, block.From, key, val)
+			submitBlock(block.Chain, block.From, key, val)
 			break
 		}
 	}
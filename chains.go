@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxDiscoveredChains stop the scan of the chain tree there, a node that
+// answers for every chain must not keep it going
+const maxDiscoveredChains = 1024
+
+// chainsMu guards conf.Chains once auto_chains may change it
+var chainsMu sync.Mutex
+
+// miningGens the generation of the miner threads of every mined chain,
+// threads of an older generation stop. Guarded by mu
+var miningGens map[uint64]int
+
+func init() {
+	miningGens = make(map[uint64]int)
+}
+
+// activeChains the chains that are mined now
+func activeChains() []uint64 {
+	chainsMu.Lock()
+	defer chainsMu.Unlock()
+	return append([]uint64(nil), conf.Chains...)
+}
+
+// defaultChain the chain of commands that are not given one
+func defaultChain() uint64 {
+	if chains := activeChains(); len(chains) > 0 {
+		return chains[0]
+	}
+	return 1
+}
+
+// discoverChains the chains that the node has. Chains form a binary tree
+// from chain 1, the children of chain c are 2c and 2c+1.
+func discoverChains() ([]uint64, error) {
+	var found []uint64
+	queue := []uint64{1}
+	for len(queue) > 0 && len(found) < maxDiscoveredChains {
+		chain := queue[0]
+		queue = queue[1:]
+		_, err := mainChainBlock(chain, 0)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("chain %d: %v", chain, err)
+		}
+		found = append(found, chain)
+		queue = append(queue, 2*chain, 2*chain+1)
+	}
+	return found, nil
+}
+
+// minableChains the chains that both the wallet and the dev wallet are miners of,
+// a chain that cannot be checked is left out
+func minableChains(chains []uint64) []uint64 {
+	var out []uint64
+	for _, chain := range chains {
+		reason, err := checkRegistration(chain)
+		if err != nil {
+			log.Printf("chain:%d, fail to check miner registration: %v\n", chain, err)
+			continue
+		}
+		if reason == "" {
+			out = append(out, chain)
+		} else if conf.Verbosity >= 3 {
+			log.Printf("chain:%d, found but %s\n", chain, reason)
+		}
+	}
+	return out
+}
+
+// startChain connect the chain and start its miner threads
+func startChain(chain uint64) {
+	startSupervisor(chain)
+	startMiners(chain)
+}
+
+// startMiners start ThreadNumber miner threads of the chain, they stop with stopChain
+func startMiners(chain uint64) {
+	mu.Lock()
+	miningGens[chain]++
+	gen := miningGens[chain]
+	mu.Unlock()
+	for i := 0; i < conf.ThreadNumber; i++ {
+		go func(c uint64, thread int) {
+			for {
+				mu.Lock()
+				block := blocks[c]
+				stopped := miningGens[c] != gen
+				paused := pausedChains[c] != ""
+				mu.Unlock()
+				if stopped {
+					return
+				}
+				if block == nil || paused {
+					time.Sleep(1 * time.Second)
+					continue
+				}
+				miner(thread, block)
+			}
+		}(chain, i)
+	}
+}
+
+// stopChain close the connections of the chain and stop its miner threads
+func stopChain(chain uint64) {
+	stopSupervisor(chain)
+	mu.Lock()
+	miningGens[chain]++
+	delete(blocks, chain)
+	delete(tips, chain)
+	delete(disagreeSince, chain)
+	delete(pausedChains, chain)
+	blockFlag++
+	mu.Unlock()
+}
+
+// updateChains mine the chains that were found and stop the chains that are gone
+func updateChains() error {
+	found, err := discoverChains()
+	if err != nil {
+		return err
+	}
+	chainsMu.Lock()
+	current := append([]uint64(nil), conf.Chains...)
+	chainsMu.Unlock()
+
+	exists := make(map[uint64]bool)
+	for _, c := range found {
+		exists[c] = true
+	}
+	mined := make(map[uint64]bool)
+	var keep, gone, candidates []uint64
+	for _, c := range current {
+		mined[c] = true
+		if exists[c] {
+			keep = append(keep, c)
+		} else {
+			gone = append(gone, c)
+		}
+	}
+	for _, c := range found {
+		if !mined[c] {
+			candidates = append(candidates, c)
+		}
+	}
+	added := minableChains(candidates)
+	next := append(keep, added...)
+	sort.Slice(next, func(i, j int) bool { return next[i] < next[j] })
+
+	chainsMu.Lock()
+	conf.Chains = next
+	chainsMu.Unlock()
+	for _, c := range gone {
+		log.Printf("chain:%d, gone from the node, stop mining it\n", c)
+		stopChain(c)
+	}
+	for _, c := range added {
+		log.Printf("chain:%d, found, start mining it\n", c)
+		startChain(c)
+	}
+	return nil
+}
+
+// watchChains look for new and removed chains every ChainScanSec, never returns
+func watchChains() {
+	for {
+		time.Sleep(time.Duration(conf.ChainScanSec) * time.Second)
+		if err := updateChains(); err != nil {
+			log.Println("fail to discover chains:", err)
+		}
+	}
+}
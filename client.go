@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// CoreApp the name of the govm core app, which owns dbCoin, dbMiner, statMining...
+const CoreApp = "ff0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+// ErrNotFound the server has no such data
+var ErrNotFound = errors.New("not found")
+
+// ServerError the server answered with an error status
+type ServerError struct {
+	Server string
+	Status int
+	Body   string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server %s: status %d: %s", e.Server, e.Status, e.Body)
+}
+
+// UnreachableError the server could not be reached or did not answer in time
+type UnreachableError struct {
+	Server string
+	Err    error
+}
+
+func (e *UnreachableError) Error() string {
+	return fmt.Sprintf("server %s unreachable: %v", e.Server, e.Err)
+}
+
+func (e *UnreachableError) Unwrap() error {
+	return e.Err
+}
+
+// NodeClient client of the govm node API of one server
+type NodeClient struct {
+	Server  string
+	Timeout time.Duration
+	http    *http.Client
+}
+
+// NewNodeClient new client of the server, using the TLS and proxy setting of conf
+func NewNodeClient(server string) *NodeClient {
+	return &NodeClient{
+		Server:  server,
+		Timeout: time.Duration(conf.RequestTimeoutSec) * time.Second,
+		http:    clientFor(server),
+	}
+}
+
+// withTimeout apply the timeout of the client unless ctx already has a deadline
+func (c *NodeClient) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || c.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.Timeout)
+}
+
+// do send the request, return the body of a 200 response
+func (c *NodeClient) do(ctx context.Context, method, path string, query url.Values, body []byte) ([]byte, http.Header, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	urlStr := apiURL(c.Server, path)
+	if len(query) > 0 {
+		urlStr += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, urlStr, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	start := time.Now()
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, &UnreachableError{c.Server, err}
+	}
+	defer resp.Body.Close()
+	recordServerDate(c.Server, resp.Header, start, time.Now())
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.Header, &UnreachableError{c.Server, err}
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, resp.Header, ErrNotFound
+	case resp.StatusCode != http.StatusOK:
+		if len(data) > 200 {
+			data = data[:200]
+		}
+		return nil, resp.Header, &ServerError{c.Server, resp.StatusCode, string(bytes.TrimSpace(data))}
+	}
+	return data, resp.Header, nil
+}
+
+func dataQuery(app, structName, key string, raw bool) url.Values {
+	if app == "" {
+		app = CoreApp
+	}
+	query := url.Values{}
+	query.Set("app_name", app)
+	query.Set("is_db_data", "true")
+	query.Set("struct_name", structName)
+	query.Set("key", key)
+	if raw {
+		query.Set("raw", "true")
+	}
+	return query
+}
+
+// Data the raw value of app/structName/key, ErrNotFound if it is empty. An empty app means CoreApp.
+func (c *NodeClient) Data(ctx context.Context, chain uint64, app, structName, key string) ([]byte, error) {
+	data, _, err := c.do(ctx, http.MethodGet, fmt.Sprintf("/api/v1/%d/data", chain), dataQuery(app, structName, key, true), nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+// DataInfo the value of app/structName/key with its life, ErrNotFound if it is empty
+func (c *NodeClient) DataInfo(ctx context.Context, chain uint64, app, structName, key string) (*DataInfo, error) {
+	data, _, err := c.do(ctx, http.MethodGet, fmt.Sprintf("/api/v1/%d/data", chain), dataQuery(app, structName, key, false), nil)
+	if err != nil {
+		return nil, err
+	}
+	info := new(DataInfo)
+	if err = json.Unmarshal(data, info); err != nil {
+		return nil, &ServerError{c.Server, http.StatusOK, "invalid data info: " + err.Error()}
+	}
+	if info.Value == "" {
+		return nil, ErrNotFound
+	}
+	return info, nil
+}
+
+// PostBlock send a solved block to the server and let it broadcast the block
+func (c *NodeClient) PostBlock(ctx context.Context, chain uint64, key, data []byte) error {
+	query := url.Values{}
+	query.Set("key", fmt.Sprintf("%x", key))
+	query.Set("broadcast", "true")
+	_, _, err := c.do(ctx, http.MethodPost, fmt.Sprintf("/api/v1/%d/data", chain), query, data)
+	return err
+}
+
+// NewTransaction send a signed transaction to the server
+func (c *NodeClient) NewTransaction(ctx context.Context, chain uint64, data []byte) error {
+	_, _, err := c.do(ctx, http.MethodPost, fmt.Sprintf("/api/v1/%d/transaction/new", chain), nil, data)
+	return err
+}
+
+// TransInfo the transaction info, Others has the BlockID that included it
+type TransInfo struct {
+	TransactionHead
+	Key    []byte
+	Size   int
+	Others map[string]interface{}
+}
+
+// BlockID the index of the block that included the transaction
+func (t *TransInfo) BlockID() uint64 {
+	id, _ := t.Others["BlockID"].(float64)
+	return uint64(id)
+}
+
+// TransactionInfo the transaction with the key, ErrNotFound until a block includes it
+func (c *NodeClient) TransactionInfo(ctx context.Context, chain uint64, key []byte) (*TransInfo, error) {
+	query := url.Values{}
+	query.Set("key", fmt.Sprintf("%x", key))
+	data, _, err := c.do(ctx, http.MethodGet, fmt.Sprintf("/api/v1/%d/transaction/info", chain), query, nil)
+	if err != nil {
+		return nil, err
+	}
+	info := new(TransInfo)
+	if err = json.Unmarshal(data, info); err != nil {
+		return nil, &ServerError{c.Server, http.StatusOK, "invalid transaction info: " + err.Error()}
+	}
+	return info, nil
+}
+
+// BlockInfo block info
+type BlockInfo struct {
+	Time     uint64 `json:"time,omitempty"`
+	Previous string `json:"previous,omitempty"`
+	Producer string `json:"producer,omitempty"`
+	Chain    uint64 `json:"chain,omitempty"`
+	Index    uint64 `json:"index,omitempty"`
+	Key      string `json:"key,omitempty"`
+}
+
+// BlockInfo the block of the index on the main chain, the last block if index is 0
+func (c *NodeClient) BlockInfo(ctx context.Context, chain, index uint64) (*BlockInfo, error) {
+	query := url.Values{}
+	if index > 0 {
+		query.Set("index", fmt.Sprintf("%d", index))
+	}
+	data, _, err := c.do(ctx, http.MethodGet, fmt.Sprintf("/api/v1/%d/block/info", chain), query, nil)
+	if err != nil {
+		return nil, err
+	}
+	info := new(BlockInfo)
+	if err = json.Unmarshal(data, info); err != nil {
+		return nil, &ServerError{c.Server, http.StatusOK, "invalid block info: " + err.Error()}
+	}
+	return info, nil
+}
+
+// DialMining open the mining websocket of the chain
+func (c *NodeClient) DialMining(ctx context.Context, chain uint64) (*websocket.Conn, *activityConn, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	return dialWebsocket(ctx, c.Server, fmt.Sprintf("/api/v1/%d/ws/mining", chain))
+}
+
+// dialWebsocket open a websocket to the path on the server, using the TLS and proxy setting of conf
+func dialWebsocket(ctx context.Context, server, path string) (*websocket.Conn, *activityConn, error) {
+	u, err := serverURL(server)
+	if err != nil {
+		return nil, nil, err
+	}
+	origin := u.String()
+	wsu := *u
+	wsu.Scheme = "ws"
+	if u.Scheme == "https" {
+		wsu.Scheme = "wss"
+	}
+	wsu.Path += path
+	config, err := websocket.NewConfig(wsu.String(), origin)
+	if err != nil {
+		return nil, nil, err
+	}
+	dialer, err := serverDialer(server)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := dialContext(ctx, dialer, "tcp", hostPort(u))
+	if err != nil {
+		return nil, nil, &UnreachableError{server, err}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		raw.SetDeadline(deadline)
+	}
+	// the watcher must have finished before returning, otherwise the cancel
+	// of the caller could still close a socket that was dialed successfully
+	stop := make(chan struct{})
+	canceled := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			raw.Close()
+			canceled <- true
+		case <-stop:
+			canceled <- false
+		}
+	}()
+	finish := func() bool {
+		close(stop)
+		return <-canceled
+	}
+
+	stream := raw
+	if cfg := serverTLS(u); cfg != nil {
+		tc := tls.Client(raw, cfg)
+		if err = tc.Handshake(); err != nil {
+			finish()
+			raw.Close()
+			return nil, nil, &UnreachableError{server, err}
+		}
+		stream = tc
+	}
+	conn := &activityConn{Conn: stream, last: time.Now().UnixNano()}
+	ws, err := websocket.NewClient(config, conn)
+	if finish() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		raw.Close()
+		return nil, nil, &UnreachableError{server, err}
+	}
+	raw.SetDeadline(time.Time{})
+	return ws, conn, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gomv-net/mining/fakenode"
+	"github.com/lengzhao/govm/wallet"
+)
+
+// setupTest load a configure with the servers and a new wallet, like main does
+func setupTest(t *testing.T, extra map[string]interface{}, servers ...string) {
+	dir, err := ioutil.TempDir("", "mining")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := map[string]interface{}{
+		"servers":               servers,
+		"keepalive_sec":         1,
+		"keepalive_timeout_sec": 1,
+		"request_timeout_sec":   2,
+	}
+	for k, v := range extra {
+		c[k] = v
+	}
+	data, _ := json.Marshal(c)
+	fileName := filepath.Join(dir, "conf.json")
+	if err = ioutil.WriteFile(fileName, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf = Config{}
+	loadConfig(fileName)
+
+	userKey = wallet.NewPrivateKey()
+	userAddress = wallet.PublicKeyToAddress(wallet.GetPublicKey(userKey), wallet.EAddrTypeDefault)
+	userAddrStr = hex.EncodeToString(userAddress)
+	devKey, devAddress, devAddrStr = userKey, userAddress, userAddrStr
+}
+
+// newTestNode a fake node with the faults, the address of its server and how to close it
+func newTestNode(f fakenode.Faults) (*fakenode.Node, string, func()) {
+	n, srv := fakenode.NewServer()
+	n.SetFaults(f)
+	return n, srv.Listener.Addr().String(), func() {
+		n.Close()
+		srv.Close()
+	}
+}
+
+func testJob(chain, index uint64) fakenode.Job {
+	job := fakenode.Job{HashpowerLimit: 2}
+	job.Chain = chain
+	job.Index = index
+	job.Time = uint64(time.Now().UnixNano() / 1000000)
+	job.Previous[0] = byte(index)
+	return job
+}
+
+// waitJob wait until the job of the chain has the index
+func waitJob(t *testing.T, chain, index uint64) *RespBlockWithKey {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		job := blocks[chain]
+		mu.Unlock()
+		if job != nil && job.Index == index {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if job := blocks[chain]; job != nil {
+		t.Fatalf("chain:%d, job %d, want %d", chain, job.Index, index)
+	}
+	t.Fatalf("chain:%d, no job, want %d", chain, index)
+	return nil
+}
+
+// runRequestBlock run requestBlock until the returned cancel is called or it returns
+func runRequestBlock(chain uint64, server string) (context.CancelFunc, chan error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := requestBlock(ctx, chain, server, new(connSlot))
+		done <- err
+	}()
+	return cancel, done
+}
+
+// solveTestBlock sign the job with the wallet until the key has the hash power limit
+func solveTestBlock(t *testing.T, job *RespBlockWithKey) ([]byte, []byte) {
+	block := job.Block
+	for block.Nonce = 0; block.Nonce < 1<<16; block.Nonce++ {
+		data := Encode(block)
+		val := append([]byte{wallet.SignLen}, wallet.Sign(job.Key, data)...)
+		val = append(val, data...)
+		key := wallet.GetHash(val)
+		if getHashPower(key) >= job.HashpowerLimit {
+			return key, val
+		}
+	}
+	t.Fatal("no solution found")
+	return nil, nil
+}
+
+func TestNodeClient(t *testing.T) {
+	n, server, closeNode := newTestNode(fakenode.Faults{})
+	defer closeNode()
+	setupTest(t, nil, server)
+	n.Push(testJob(1, 3))
+	n.SetGuerdon(1, 50)
+	n.SetCoins(1, userAddrStr, 2*govmUnit)
+	ctx := context.Background()
+	c := NewNodeClient(server)
+
+	coins, err := getCoins(ctx, c, 1, userAddrStr)
+	if err != nil || coins != 2*govmUnit {
+		t.Fatalf("balance %d, %v", coins, err)
+	}
+	if coins, err = getCoins(ctx, c, 1, hex.EncodeToString(make([]byte, AddressLen))); err != nil || coins != 0 {
+		t.Fatalf("balance of an unknown address %d, %v", coins, err)
+	}
+	if guerdon, err := getGuerdon(ctx, c, 1); err != nil || guerdon != 50 {
+		t.Fatalf("guerdon %d, %v", guerdon, err)
+	}
+	if _, err = c.Data(ctx, 1, "", "statMining", userAddrStr); err != ErrNotFound {
+		t.Fatalf("missing data: %v, want ErrNotFound", err)
+	}
+	if _, err = c.DataInfo(ctx, 1, "", "dbMiner", userAddrStr); err != ErrNotFound {
+		t.Fatalf("missing data info: %v, want ErrNotFound", err)
+	}
+
+	if ok, err := isMiner(1, server, userAddrStr); ok || err != nil {
+		t.Fatalf("isMiner before the registration: %t, %v", ok, err)
+	}
+	n.SetMiner(1, userAddrStr)
+	if ok, err := isMiner(1, server, userAddrStr); !ok || err != nil {
+		t.Fatalf("isMiner after the registration: %t, %v", ok, err)
+	}
+	m, err := getMinerRecord(ctx, c, 1, userAddrStr)
+	if err != nil || !m.HasIndex || m.Index != 4 || m.Cost != 150 || hex.EncodeToString(m.User[:]) != userAddrStr {
+		t.Fatalf("registration %+v, %v", m, err)
+	}
+	// any value is a registration, whatever its layout
+	n.SetData(1, "", "dbMiner", userAddrStr, []byte{1, 2, 3})
+	if ok, err := isMiner(1, server, userAddrStr); !ok || err != nil {
+		t.Fatalf("isMiner with a 3 bytes registration: %t, %v", ok, err)
+	}
+
+	info, err := c.BlockInfo(ctx, 1, 0)
+	if err != nil || info.Index != 2 {
+		t.Fatalf("last block %+v, %v", info, err)
+	}
+	if _, err = NewNodeClient("127.0.0.1:1").BlockInfo(ctx, 1, 0); err == nil {
+		t.Fatal("no error from a closed port")
+	} else if _, ok := err.(*UnreachableError); !ok {
+		t.Fatalf("error %T %v, want UnreachableError", err, err)
+	}
+}
+
+func TestRequestBlock(t *testing.T) {
+	n, server, closeNode := newTestNode(fakenode.Faults{})
+	defer closeNode()
+	setupTest(t, nil, server)
+	const chain = 11
+	n.AutoAdvance = true
+	n.Push(testJob(chain, 5))
+
+	cancel, done := runRequestBlock(chain, server)
+	defer cancel()
+	job := waitJob(t, chain, 5)
+	if job.From != server || hex.EncodeToString(job.Producer[:]) != userAddrStr {
+		t.Fatalf("job from %s producer %x", job.From, job.Producer)
+	}
+	if miners := n.Miners(); len(miners) != 1 || miners[0] != userAddrStr {
+		t.Fatalf("handshake of %s not seen, miners %v", userAddrStr, miners)
+	}
+
+	key, data := solveTestBlock(t, job)
+	if err := NewNodeClient(server).PostBlock(context.Background(), chain, key, data); err != nil {
+		t.Fatal("the node refused the block:", err)
+	}
+	posted := n.Posted()
+	if len(posted) != 1 || !posted[0].Valid {
+		t.Fatalf("posted %+v", posted)
+	}
+	// the node advances to the next index on the block
+	waitJob(t, chain, 6)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("requestBlock did not return on cancel")
+	}
+}
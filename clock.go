@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// clockSamples the Date headers kept per server, the offset is their median
+const clockSamples = 9
+
+// serverClock what the responses and jobs of a server tell about its clock
+type serverClock struct {
+	// Samples offsets of the server clock from the Date headers, newest last
+	Samples []time.Duration
+	// JobAhead how far the time of its last job was ahead of the local clock.
+	// A job is never newer than the clock of its server, so that is a lower
+	// bound of the offset.
+	JobAhead time.Duration
+	HasJob   bool
+	Warned   bool
+}
+
+var clockMu sync.Mutex
+var clocks map[string]*serverClock
+
+func init() {
+	clocks = make(map[string]*serverClock)
+}
+
+// unsafeClock must be called with clockMu held
+func unsafeClock(server string) *serverClock {
+	c := clocks[server]
+	if c == nil {
+		c = new(serverClock)
+		clocks[server] = c
+	}
+	return c
+}
+
+// offset the estimated offset of the server clock, ok is false without any Date
+// sample. JobAhead only raises the estimate, alone it is no estimate at all.
+func (c *serverClock) offset() (time.Duration, bool) {
+	if len(c.Samples) == 0 {
+		return 0, false
+	}
+	sorted := append([]time.Duration(nil), c.Samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	out := sorted[len(sorted)/2]
+	if c.HasJob && c.JobAhead > out {
+		out = c.JobAhead
+	}
+	return out, true
+}
+
+// unsafeCheckSkew must be called with clockMu held, warn once when the clock of
+// the server is off by more than ClockSkewWarnSec
+func unsafeCheckSkew(server string, c *serverClock) {
+	off, ok := c.offset()
+	if !ok {
+		return
+	}
+	limit := time.Duration(conf.ClockSkewWarnSec) * time.Second
+	skewed := off > limit || off < -limit
+	if skewed && !c.Warned {
+		log.Printf("WARNING, the clock of %s is %s off the local clock, correcting it. Please sync the clock (NTP)\n",
+			server, off.Round(time.Millisecond))
+	}
+	c.Warned = skewed
+}
+
+// recordServerDate take the Date header of a response that was requested at
+// start and arrived at end
+func recordServerDate(server string, header http.Header, start, end time.Time) {
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		return
+	}
+	// Date has whole seconds, the server time was half a second later on average
+	local := start.Add(end.Sub(start) / 2)
+	off := date.Add(500 * time.Millisecond).Sub(local)
+	clockMu.Lock()
+	defer clockMu.Unlock()
+	c := unsafeClock(server)
+	c.Samples = append(c.Samples, off)
+	if len(c.Samples) > clockSamples {
+		c.Samples = c.Samples[1:]
+	}
+	unsafeCheckSkew(server, c)
+}
+
+// recordJobTime take the time (ms) of a job that just arrived from the server
+func recordJobTime(server string, jobTime uint64) {
+	if jobTime == 0 {
+		return
+	}
+	ahead := time.Unix(0, int64(jobTime)*int64(time.Millisecond)).Sub(time.Now())
+	clockMu.Lock()
+	defer clockMu.Unlock()
+	c := unsafeClock(server)
+	c.JobAhead = ahead
+	c.HasJob = true
+	unsafeCheckSkew(server, c)
+}
+
+// sampleClock ask the server for its last block if nothing is known about its
+// clock yet, so that the Date header is there before the first handshake
+func sampleClock(ctx context.Context, chain uint64, server string) {
+	clockMu.Lock()
+	known := len(unsafeClock(server).Samples) > 0
+	clockMu.Unlock()
+	if !known {
+		NewNodeClient(server).BlockInfo(ctx, chain, 0)
+	}
+}
+
+// serverClockOffset the estimated offset of the server clock, ok is false without any Date sample
+func serverClockOffset(server string) (time.Duration, bool) {
+	clockMu.Lock()
+	defer clockMu.Unlock()
+	return unsafeClock(server).offset()
+}
+
+// clockOffset the median of the offsets of all servers
+func clockOffset() time.Duration {
+	var offsets []time.Duration
+	for _, server := range conf.Servers {
+		if off, ok := serverClockOffset(server); ok {
+			offsets = append(offsets, off)
+		}
+	}
+	if len(offsets) == 0 {
+		return 0
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return offsets[len(offsets)/2]
+}
+
+// nodeNow the local time corrected by the clocks of the servers
+func nodeNow() time.Time {
+	return time.Now().Add(clockOffset())
+}
+
+// serverNow the local time corrected by the clock of the server, by the
+// clocks of all servers if nothing is known about it
+func serverNow(server string) time.Time {
+	if off, ok := serverClockOffset(server); ok {
+		return time.Now().Add(off)
+	}
+	return nodeNow()
+}
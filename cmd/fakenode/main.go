@@ -0,0 +1,101 @@
+// Command fakenode runs a stand-in govm node, so that the miner can be run offline.
+//
+//	fakenode -listen 127.0.0.1:9090 -chains 1 -hp 16 -miner <address>
+//
+// Then put "127.0.0.1:9090" in the servers of conf.json. The fault flags
+// (-truncate, -malformed, -delay...) make the node misbehave on purpose.
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomv-net/mining/fakenode"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:9090", "address to listen on")
+	chains := flag.String("chains", "1", "comma separated chains to serve")
+	hp := flag.Uint64("hp", 16, "hash power limit of the jobs")
+	miners := flag.String("miner", "", "comma separated addresses (hex) registered as miners")
+	coins := flag.Uint64("coins", 0, "balance of every miner and account")
+	accounts := flag.String("accounts", "", "comma separated addresses (hex) that get coins without being miners")
+	guerdon := flag.Uint64("guerdon", 0, "guerdon of the chains, miners register with 3 times of it")
+	maxSkew := flag.Duration("max-clock-skew", 0, "refuse websocket handshakes whose time is off by more, 0 to accept all")
+	interval := flag.Duration("interval", time.Minute, "push a new job this often even if nothing is mined, 0 to disable")
+	var faults fakenode.Faults
+	flag.BoolVar(&faults.TruncateRaw, "truncate", false, "fault: truncate raw data responses")
+	flag.BoolVar(&faults.MalformedJSON, "malformed", false, "fault: send malformed json")
+	flag.BoolVar(&faults.OutOfOrder, "out-of-order", false, "fault: follow every job with an older one")
+	flag.BoolVar(&faults.Duplicate, "duplicate", false, "fault: send every job twice")
+	flag.DurationVar(&faults.Delay, "delay", 0, "fault: delay every response and job")
+	flag.IntVar(&faults.DisconnectAfter, "disconnect-after", 0, "fault: close the websocket after that many jobs")
+	flag.IntVar(&faults.HangAfter, "hang-after", 0, "fault: stop responding on the websocket after that many jobs")
+	flag.DurationVar(&faults.ClockOffset, "clock-offset", 0, "fault: run the clock of the node that far ahead, negative for behind")
+	flag.Parse()
+
+	n := fakenode.New()
+	n.AutoAdvance = true
+	n.MaxClockSkew = *maxSkew
+	n.SetFaults(faults)
+	var list []uint64
+	for _, s := range strings.Split(*chains, ",") {
+		c, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			log.Fatalln("invalid chain:", s)
+		}
+		list = append(list, c)
+		job := fakenode.Job{HashpowerLimit: *hp}
+		job.Chain = c
+		job.Index = 1
+		job.Time = uint64(n.Now().UnixNano() / 1000000)
+		n.Push(job)
+		n.SetGuerdon(c, *guerdon)
+		for _, addr := range strings.Split(*miners, ",") {
+			if addr = strings.TrimSpace(addr); addr == "" {
+				continue
+			}
+			n.SetMiner(c, addr)
+			n.SetCoins(c, addr, *coins)
+		}
+		for _, addr := range strings.Split(*accounts, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				n.SetCoins(c, addr, *coins)
+			}
+		}
+	}
+
+	if *interval > 0 {
+		go func() {
+			for range time.Tick(*interval) {
+				for _, c := range list {
+					// somebody else mined the current job
+					job, _ := n.Current(c)
+					rand.Read(job.Previous[:])
+					job.Index++
+					job.Time = uint64(n.Now().UnixNano() / 1000000)
+					n.Push(job)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for range time.Tick(10 * time.Second) {
+			for _, b := range n.Posted() {
+				if time.Since(b.Time) < 10*time.Second {
+					log.Printf("posted chain:%d index:%d hp:%d valid:%t %s\n",
+						b.Chain, b.Block.Index, b.HashPower, b.Valid, b.Reason)
+				}
+			}
+		}
+	}()
+
+	log.Println("fake govm node listening on", *listen)
+	log.Fatal(http.ListenAndServe(*listen, n))
+}
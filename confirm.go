@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+// confirmDepth the blocks on top of a submitted block before it is counted
+// as accepted or orphaned, a shorter fork can still replace it before that
+const confirmDepth = 3
+
+// confirmIntervalSec how often the pending blocks are checked
+const confirmIntervalSec = 20
+
+// trackedBlock a block this process found and submitted
+type trackedBlock struct {
+	Index uint64
+	Key   []byte
+}
+
+// chainConfirms what became of the submitted blocks of a chain
+type chainConfirms struct {
+	Accepted uint64
+	Orphaned uint64
+	Pending  []trackedBlock
+}
+
+var confirmMu sync.Mutex
+var confirms map[uint64]*chainConfirms
+
+func init() {
+	confirms = make(map[uint64]*chainConfirms)
+}
+
+// trackConfirms check the pending blocks every confirmIntervalSec, never returns
+func trackConfirms() {
+	for {
+		time.Sleep(confirmIntervalSec * time.Second)
+		for _, chain := range pendingConfirmChains() {
+			checkConfirms(chain)
+		}
+	}
+}
+
+// unsafeChainConfirms must be called with confirmMu held
+func unsafeChainConfirms(chain uint64) *chainConfirms {
+	c := confirms[chain]
+	if c == nil {
+		c = new(chainConfirms)
+		confirms[chain] = c
+	}
+	return c
+}
+
+// trackBlock remember the submitted block until the node tells whether it is on the main chain
+func trackBlock(chain, index uint64, key []byte) {
+	confirmMu.Lock()
+	c := unsafeChainConfirms(chain)
+	c.Pending = append(c.Pending, trackedBlock{Index: index, Key: key})
+	confirmMu.Unlock()
+}
+
+// confirmCounts the accepted, orphaned and pending blocks of the chain
+func confirmCounts(chain uint64) (uint64, uint64, uint64) {
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
+	c := confirms[chain]
+	if c == nil {
+		return 0, 0, 0
+	}
+	return c.Accepted, c.Orphaned, uint64(len(c.Pending))
+}
+
+// totalConfirmCounts the accepted and orphaned blocks of all chains
+func totalConfirmCounts() (uint64, uint64) {
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
+	var accepted, orphaned uint64
+	for _, c := range confirms {
+		accepted += c.Accepted
+		orphaned += c.Orphaned
+	}
+	return accepted, orphaned
+}
+
+func pendingConfirmChains() []uint64 {
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
+	var out []uint64
+	for chain, c := range confirms {
+		if len(c.Pending) > 0 {
+			out = append(out, chain)
+		}
+	}
+	return out
+}
+
+// mainChainBlock the block at the index on the main chain, from the first server that answers.
+// Index 0 means the last block. ErrNotFound is an answer, the index has no block.
+func mainChainBlock(chain, index uint64) (*BlockInfo, error) {
+	var lastErr error
+	for _, server := range conf.Servers {
+		info, err := NewNodeClient(server).BlockInfo(context.Background(), chain, index)
+		if err == nil || err == ErrNotFound {
+			return info, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// checkConfirms ask the node about the pending blocks of the chain that are
+// confirmDepth blocks deep
+func checkConfirms(chain uint64) {
+	last, err := mainChainBlock(chain, 0)
+	if err != nil {
+		if conf.Verbosity >= 3 {
+			log.Printf("chain:%d, fail to get the last block: %v\n", chain, err)
+		}
+		return
+	}
+
+	confirmMu.Lock()
+	pending := append([]trackedBlock(nil), unsafeChainConfirms(chain).Pending...)
+	confirmMu.Unlock()
+
+	decided := make(map[string]bool)
+	for _, b := range pending {
+		if b.Index+confirmDepth > last.Index {
+			continue
+		}
+		info, err := mainChainBlock(chain, b.Index)
+		if err != nil && err != ErrNotFound {
+			if conf.Verbosity >= 3 {
+				log.Printf("chain:%d, fail to get block %d: %v\n", chain, b.Index, err)
+			}
+			break
+		}
+		k := hex.EncodeToString(b.Key)
+		accepted := err == nil && info.Key == k
+		decided[k] = accepted
+		if accepted {
+			ledgerConfirm(b.Key)
+		}
+		if conf.Verbosity >= 3 {
+			if accepted {
+				log.Printf("chain:%d, block %d accepted, key:%x\n", chain, b.Index, b.Key)
+			} else {
+				log.Printf("chain:%d, block %d orphaned, key:%x\n", chain, b.Index, b.Key)
+			}
+		}
+	}
+	if len(decided) == 0 {
+		return
+	}
+
+	confirmMu.Lock()
+	c := unsafeChainConfirms(chain)
+	var rest []trackedBlock
+	for _, b := range c.Pending {
+		accepted, ok := decided[hex.EncodeToString(b.Key)]
+		switch {
+		case !ok:
+			rest = append(rest, b)
+		case accepted:
+			c.Accepted++
+		default:
+			c.Orphaned++
+		}
+	}
+	c.Pending = rest
+	confirmMu.Unlock()
+}
@@ -0,0 +1,60 @@
+package fakenode
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// hangConn the connection under a mining websocket. Once hung it swallows
+// everything the miner sends, pings included, so nothing is answered, and
+// only reports that the miner went away.
+type hangConn struct {
+	net.Conn
+	once sync.Once
+	hung chan struct{}
+}
+
+func newHangConn() *hangConn {
+	return &hangConn{hung: make(chan struct{})}
+}
+
+// hang stop passing data to the websocket
+func (c *hangConn) hang() {
+	c.once.Do(func() { close(c.hung) })
+}
+
+func (c *hangConn) Read(b []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(b)
+		select {
+		case <-c.hung:
+			if err != nil {
+				return 0, err
+			}
+		default:
+			return n, err
+		}
+	}
+}
+
+// hangWriter hand the hijacked connection to the websocket through hc
+type hangWriter struct {
+	http.ResponseWriter
+	hc *hangConn
+}
+
+func (w *hangWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hc.Conn = conn
+	// what the server has read ahead comes first
+	buffered, _ := rw.Reader.Peek(rw.Reader.Buffered())
+	r := io.MultiReader(bytes.NewReader(append([]byte{}, buffered...)), w.hc)
+	return w.hc, bufio.NewReadWriter(bufio.NewReader(r), bufio.NewWriter(w.hc)), nil
+}
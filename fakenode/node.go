@@ -0,0 +1,576 @@
+// Package fakenode is a stand-in govm node for running the miner offline.
+// It serves the mining websocket with scripted jobs, answers data queries
+// from an in-memory store and records the blocks that miners post.
+package fakenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lengzhao/govm/wallet"
+	"golang.org/x/net/websocket"
+)
+
+// CoreApp the name of the govm core app
+const CoreApp = "ff0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+// Hash the key of a block
+type Hash [32]byte
+
+// Address wallet address
+type Address [24]byte
+
+// MarshalJSON marshal by base64, like the node
+func (h Hash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h[:])
+}
+
+// UnmarshalJSON UnmarshalJSON
+func (h *Hash) UnmarshalJSON(b []byte) error {
+	var v []byte
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return err
+	}
+	copy(h[:], v)
+	return nil
+}
+
+// MarshalJSON marshal by base64, like the node
+func (a Address) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a[:])
+}
+
+// UnmarshalJSON UnmarshalJSON
+func (a *Address) UnmarshalJSON(b []byte) error {
+	var v []byte
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return err
+	}
+	copy(a[:], v)
+	return nil
+}
+
+// Block the block header that is mined
+type Block struct {
+	Time          uint64
+	Previous      Hash
+	Parent        Hash
+	LeftChild     Hash
+	RightChild    Hash
+	TransListHash Hash
+	Producer      Address
+	Chain         uint64
+	Index         uint64
+	Nonce         uint64
+}
+
+// Job a job sent on the mining websocket
+type Job struct {
+	Block
+	HashpowerLimit uint64
+}
+
+// PostedBlock a block posted by a miner
+type PostedBlock struct {
+	Chain     uint64
+	Key       []byte
+	Block     Block
+	HashPower uint64
+	Valid     bool
+	Reason    string
+	Time      time.Time
+}
+
+// Faults misbehavior of the node, to check that the miner survives it
+type Faults struct {
+	// TruncateRaw answer raw data queries with only half of the value
+	TruncateRaw bool
+	// MalformedJSON send broken json before every job and as data info
+	MalformedJSON bool
+	// OutOfOrder follow every job with an older one
+	OutOfOrder bool
+	// Duplicate send every job twice
+	Duplicate bool
+	// Delay wait before every response and every job
+	Delay time.Duration
+	// DisconnectAfter close the websocket after sending that many jobs
+	DisconnectAfter int
+	// HangAfter stop sending and reading, pongs included, after that many jobs
+	HangAfter int
+	// ClockOffset run the clock of the node that far ahead of the local one,
+	// negative for behind. It moves the Date headers, the handshake check and
+	// the time of the jobs pushed with Now.
+	ClockOffset time.Duration
+}
+
+// Node the fake node
+type Node struct {
+	// AutoAdvance push the next job once a valid block is posted for the current one
+	AutoAdvance bool
+	// MaxClockSkew how far the time of a websocket handshake may be off, 0 means no check
+	MaxClockSkew time.Duration
+
+	mu      sync.Mutex
+	faults  Faults
+	jobs    map[uint64]*Job
+	subs    map[uint64]map[chan Job]bool
+	data    map[uint64]map[string][]byte
+	posted  []PostedBlock
+	miners  []string
+	started time.Time
+	trans   map[uint64]map[string]*Transaction
+	pending map[uint64][]*Transaction
+	blocks  map[uint64]map[uint64]BlockInfo
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// New create a node without jobs or data
+func New() *Node {
+	return &Node{
+		jobs:    make(map[uint64]*Job),
+		subs:    make(map[uint64]map[chan Job]bool),
+		data:    make(map[uint64]map[string][]byte),
+		started: time.Now(),
+		trans:   make(map[uint64]map[string]*Transaction),
+		pending: make(map[uint64][]*Transaction),
+		blocks:  make(map[uint64]map[uint64]BlockInfo),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Close end the mining websockets, hung ones included. Close the http server too.
+func (n *Node) Close() {
+	n.once.Do(func() { close(n.closed) })
+}
+
+// NewServer create a node and serve it on a local httptest server.
+// The address of the server, usable in the servers list of the miner, is s.Listener.Addr().
+func NewServer() (*Node, *httptest.Server) {
+	n := New()
+	return n, httptest.NewServer(n)
+}
+
+func dataKey(app, structName, key string) string {
+	if app == "" {
+		app = CoreApp
+	}
+	return app + "/" + structName + "/" + strings.ToLower(key)
+}
+
+// SetData set the raw value of app/structName/key on the chain, an empty app means CoreApp
+func (n *Node) SetData(chain uint64, app, structName, key string, value []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.data[chain] == nil {
+		n.data[chain] = make(map[string][]byte)
+	}
+	n.data[chain][dataKey(app, structName, key)] = value
+}
+
+// GetData the raw value of app/structName/key on the chain
+func (n *Node) GetData(chain uint64, app, structName, key string) []byte {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.data[chain][dataKey(app, structName, key)]
+}
+
+func encodeUint64(v uint64) []byte {
+	out := make([]byte, 8)
+	binary.BigEndian.PutUint64(out, v)
+	return out
+}
+
+// SetMiner register the address (hex) as a miner of the chain, for 3 times of the guerdon
+func (n *Node) SetMiner(chain uint64, addr string) {
+	r := minerRecord{Index: n.currentIndex(chain) + 1}
+	hex.Decode(r.User[:], []byte(addr))
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	r.Cost = 3 * n.unsafeUint64(chain, "dbStat", "02")
+	n.unsafeSetData(chain, "dbMiner", addr, r.encode())
+}
+
+// SetCoins set the balance of the address (hex) on the chain
+func (n *Node) SetCoins(chain uint64, addr string, coins uint64) {
+	n.SetData(chain, "", "dbCoin", addr, encodeUint64(coins))
+}
+
+// SetMiningStat set the number of blocks mined by the address (hex) on the chain
+func (n *Node) SetMiningStat(chain uint64, addr string, count uint64) {
+	n.SetData(chain, "", "statMining", addr, encodeUint64(count))
+}
+
+func (n *Node) currentIndex(chain uint64) uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if job := n.jobs[chain]; job != nil {
+		return job.Index
+	}
+	return 0
+}
+
+// SetFaults change the misbehavior of the node, Faults{} makes it behave again
+func (n *Node) SetFaults(f Faults) {
+	n.mu.Lock()
+	n.faults = f
+	n.mu.Unlock()
+}
+
+func (n *Node) getFaults() Faults {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.faults
+}
+
+// Now the time on the clock of the node
+func (n *Node) Now() time.Time {
+	return time.Now().Add(n.getFaults().ClockOffset)
+}
+
+// Push make the job the current one of its chain and send it to all miners of the chain.
+// A job with a higher index seals the current one as the block job.Previous.
+func (n *Node) Push(job Job) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if old := n.jobs[job.Chain]; old != nil && job.Index > old.Index {
+		n.unsafeSealBlock(old, job.Previous)
+	}
+	j := job
+	n.jobs[job.Chain] = &j
+	for ch := range n.subs[job.Chain] {
+		select {
+		case ch <- job:
+		default:
+		}
+	}
+}
+
+// Script push the jobs one after another, waiting interval between them
+func (n *Node) Script(interval time.Duration, jobs ...Job) {
+	go func() {
+		for i, job := range jobs {
+			if i > 0 {
+				time.Sleep(interval)
+			}
+			n.Push(job)
+		}
+	}()
+}
+
+// Current the current job of the chain
+func (n *Node) Current(chain uint64) (Job, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if job := n.jobs[chain]; job != nil {
+		return *job, true
+	}
+	return Job{}, false
+}
+
+// Posted the blocks posted so far
+func (n *Node) Posted() []PostedBlock {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]PostedBlock{}, n.posted...)
+}
+
+// Miners the addresses (hex) of the miners that passed the websocket handshake
+func (n *Node) Miners() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string{}, n.miners...)
+}
+
+// ServeHTTP serve the subset of the node API used by the miner
+func (n *Node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// /api/v1/{chain}/...
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 4 || parts[0] != "api" || parts[1] != "v1" {
+		http.NotFound(w, r)
+		return
+	}
+	chain, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("error chain"))
+		return
+	}
+	route := strings.Join(parts[3:], "/")
+	w.Header().Set("Date", n.Now().UTC().Format(http.TimeFormat))
+	if d := n.getFaults().Delay; d > 0 && route != "ws/mining" {
+		time.Sleep(d)
+	}
+	switch {
+	case route == "ws/mining":
+		hc := newHangConn()
+		s := websocket.Server{Handler: func(ws *websocket.Conn) { n.serveMining(chain, ws, hc) }}
+		s.ServeHTTP(&hangWriter{w, hc}, r)
+	case route == "data" && r.Method == http.MethodGet:
+		n.serveData(chain, w, r)
+	case route == "data" && r.Method == http.MethodPost:
+		n.servePost(chain, w, r)
+	case route == "transaction/new" && r.Method == http.MethodPost:
+		n.serveNewTransaction(chain, w, r)
+	case route == "transaction/info":
+		n.serveTransactionInfo(chain, w, r)
+	case route == "block/info":
+		n.serveBlockInfo(chain, w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// wsHead the handshake of the mining websocket
+type wsHead struct {
+	Addr Address
+	Time int64
+}
+
+func (n *Node) serveMining(chain uint64, ws *websocket.Conn, hc *hangConn) {
+	defer ws.Close()
+	buf := make([]byte, 256)
+	l, err := ws.Read(buf)
+	if err != nil {
+		return
+	}
+	headLen := binary.Size(wsHead{})
+	if l <= headLen {
+		log.Println("fakenode: short handshake", l)
+		return
+	}
+	head := wsHead{}
+	binary.Read(bytes.NewReader(buf[:headLen]), binary.BigEndian, &head)
+	if !wallet.Recover(head.Addr[:], buf[headLen:l], buf[:headLen]) {
+		log.Printf("fakenode: bad handshake signature of %x\n", head.Addr)
+		return
+	}
+	if n.MaxClockSkew > 0 {
+		skew := n.Now().Sub(time.Unix(head.Time, 0))
+		if skew > n.MaxClockSkew || -skew > n.MaxClockSkew {
+			log.Printf("fakenode: handshake time of %x is off by %s\n", head.Addr, skew)
+			return
+		}
+	}
+
+	ch := make(chan Job, 16)
+	n.mu.Lock()
+	n.miners = append(n.miners, hex.EncodeToString(head.Addr[:]))
+	if n.subs[chain] == nil {
+		n.subs[chain] = make(map[chan Job]bool)
+	}
+	n.subs[chain][ch] = true
+	if job := n.jobs[chain]; job != nil {
+		ch <- *job
+	}
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.subs[chain], ch)
+		n.mu.Unlock()
+	}()
+
+	// the miner only sends pings, a read error means it went away.
+	// Pings are answered inside Read, hc swallows them once hung.
+	closed := make(chan struct{})
+	go func() {
+		for {
+			if _, err := ws.Read(buf); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+	var sent int
+	for {
+		select {
+		case job := <-ch:
+			f := n.getFaults()
+			if f.Delay > 0 {
+				time.Sleep(f.Delay)
+			}
+			if f.MalformedJSON {
+				websocket.Message.Send(ws, `{"Index":`)
+			}
+			if err = websocket.JSON.Send(ws, job); err != nil {
+				return
+			}
+			if f.Duplicate {
+				websocket.JSON.Send(ws, job)
+			}
+			if f.OutOfOrder && job.Index > 0 {
+				old := job
+				old.Index--
+				websocket.JSON.Send(ws, old)
+			}
+			sent++
+			if f.HangAfter > 0 && sent >= f.HangAfter {
+				// keep the connection open without a word, like a dead peer,
+				// until the miner gives up or the node is closed
+				hc.hang()
+				select {
+				case <-closed:
+				case <-n.closed:
+				}
+				return
+			}
+			if f.DisconnectAfter > 0 && sent >= f.DisconnectAfter {
+				return
+			}
+		case <-closed:
+			return
+		case <-n.closed:
+			return
+		}
+	}
+}
+
+// DataInfo the json response of a data query
+type DataInfo struct {
+	AppName    string `json:"app_name,omitempty"`
+	StructName string `json:"struct_name,omitempty"`
+	IsDBData   bool   `json:"is_db_data,omitempty"`
+	Key        string `json:"key,omitempty"`
+	Value      string `json:"value,omitempty"`
+	Life       uint64 `json:"life,omitempty"`
+}
+
+func (n *Node) serveData(chain uint64, w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	info := DataInfo{}
+	info.AppName = r.Form.Get("app_name")
+	info.StructName = r.Form.Get("struct_name")
+	info.Key = r.Form.Get("key")
+	info.IsDBData = r.Form.Get("is_db_data") == "true"
+	if _, err := hex.DecodeString(info.Key); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "fail to Decode preKey,", info.Key, err)
+		return
+	}
+	val := n.GetData(chain, info.AppName, info.StructName, info.Key)
+	f := n.getFaults()
+	if r.Form.Get("raw") == "true" {
+		if f.TruncateRaw {
+			val = val[:len(val)/2]
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(val)
+		return
+	}
+	if f.MalformedJSON {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"value":"`))
+		return
+	}
+	info.Value = hex.EncodeToString(val)
+	if len(val) > 0 {
+		info.Life = uint64(n.started.Add(365*24*time.Hour).UnixNano() / 1000000)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(info)
+}
+
+// hashPower the number of leading zero bits of the key
+func hashPower(in []byte) uint64 {
+	var out uint64
+	for _, item := range in {
+		out += 8
+		if item != 0 {
+			for item > 0 {
+				out--
+				item = item >> 1
+			}
+			return out
+		}
+	}
+	return out
+}
+
+// checkBlock decode a posted block and check it against the current job
+func (n *Node) checkBlock(chain uint64, key, data []byte) PostedBlock {
+	rst := PostedBlock{Chain: chain, Key: key, Time: time.Now()}
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		rst.Reason = "short data"
+		return rst
+	}
+	signLen := int(data[0])
+	sign := data[1 : 1+signLen]
+	body := data[1+signLen:]
+	if binary.Read(bytes.NewReader(body), binary.BigEndian, &rst.Block) != nil {
+		rst.Reason = "short block"
+		return rst
+	}
+	if !bytes.Equal(wallet.GetHash(data), key) {
+		rst.Reason = "key is not the hash of the data"
+		return rst
+	}
+	rst.HashPower = hashPower(key)
+	if !wallet.Recover(rst.Block.Producer[:], sign, body) {
+		rst.Reason = "bad signature of the producer"
+		return rst
+	}
+	job, ok := n.Current(chain)
+	switch {
+	case !ok:
+		rst.Reason = "no job"
+	case rst.Block.Chain != chain || rst.Block.Index != job.Index || rst.Block.Previous != job.Previous:
+		rst.Reason = fmt.Sprintf("not the current job, index:%d current:%d", rst.Block.Index, job.Index)
+	case rst.HashPower < job.HashpowerLimit:
+		rst.Reason = fmt.Sprintf("hash power %d lower than %d", rst.HashPower, job.HashpowerLimit)
+	default:
+		rst.Valid = true
+	}
+	return rst
+}
+
+func (n *Node) servePost(chain uint64, w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	key, err := hex.DecodeString(r.Form.Get("key"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "fail to Decode preKey,", r.Form.Get("key"), err)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "fail to read body of request,", err)
+		return
+	}
+	rst := n.checkBlock(chain, key, data)
+	n.mu.Lock()
+	n.posted = append(n.posted, rst)
+	n.mu.Unlock()
+	if !rst.Valid {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error:%s", rst.Reason)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	if n.AutoAdvance {
+		job, _ := n.Current(chain)
+		next := job
+		next.Index++
+		next.Time = uint64(n.Now().UnixNano() / 1000000)
+		copy(next.Previous[:], key)
+		next.Producer = Address{}
+		next.Nonce = 0
+		n.Push(next)
+	}
+}
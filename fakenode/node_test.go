@@ -0,0 +1,429 @@
+package fakenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lengzhao/govm/wallet"
+	"golang.org/x/net/websocket"
+)
+
+// testMiner a wallet that signs handshakes, blocks and transactions
+type testMiner struct {
+	key  []byte
+	addr Address
+	hex  string
+}
+
+func newTestMiner() testMiner {
+	key := wallet.NewPrivateKey()
+	var m testMiner
+	m.key = key
+	copy(m.addr[:], wallet.PublicKeyToAddress(wallet.GetPublicKey(key), wallet.EAddrTypeDefault))
+	m.hex = hex.EncodeToString(m.addr[:])
+	return m
+}
+
+func encode(t *testing.T, v interface{}) []byte {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, v); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// signed sign + data, like blocks and transactions are sent to the node
+func (m testMiner) signed(data []byte) []byte {
+	sign := wallet.Sign(m.key, data)
+	out := append([]byte{uint8(len(sign))}, sign...)
+	return append(out, data...)
+}
+
+// dial open the mining websocket of the chain and send the handshake signed with signer
+func (m testMiner) dial(t *testing.T, srv *httptest.Server, chain uint64, at time.Time, signer testMiner) *websocket.Conn {
+	u := strings.Replace(srv.URL, "http", "ws", 1) + fmt.Sprintf("/api/v1/%d/ws/mining", chain)
+	ws, err := websocket.Dial(u, "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := encode(t, wsHead{m.addr, at.Unix()})
+	if _, err = ws.Write(append(head, wallet.Sign(signer.key, head)...)); err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+// solve a block of the job produced by m with at least the hash power
+func (m testMiner) solve(t *testing.T, job Job, hp uint64) (Hash, []byte) {
+	block := job.Block
+	block.Producer = m.addr
+	for block.Nonce = 0; block.Nonce < 1<<16; block.Nonce++ {
+		data := m.signed(encode(t, block))
+		var key Hash
+		copy(key[:], wallet.GetHash(data))
+		if hashPower(key[:]) >= hp {
+			return key, data
+		}
+	}
+	t.Fatal("no solution found")
+	return Hash{}, nil
+}
+
+func newJob(chain, index, hp uint64) Job {
+	job := Job{HashpowerLimit: hp}
+	job.Chain = chain
+	job.Index = index
+	job.Time = uint64(time.Now().UnixNano() / 1000000)
+	job.Previous[0] = byte(index)
+	return job
+}
+
+func TestHandshake(t *testing.T) {
+	n, srv := NewServer()
+	defer srv.Close()
+	defer n.Close()
+	n.MaxClockSkew = time.Minute
+	n.Push(newJob(1, 5, 10))
+	miner := newTestMiner()
+	other := newTestMiner()
+
+	cases := []struct {
+		name   string
+		signer testMiner
+		at     time.Time
+		ok     bool
+	}{
+		{"signed", miner, time.Now(), true},
+		{"signed by another wallet", other, time.Now(), false},
+		{"clock off", miner, time.Now().Add(-time.Hour), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ws := miner.dial(t, srv, 1, c.at, c.signer)
+			defer ws.Close()
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			var job Job
+			err := websocket.JSON.Receive(ws, &job)
+			if c.ok && (err != nil || job.Index != 5) {
+				t.Fatalf("want job 5, got %d, %v", job.Index, err)
+			}
+			if !c.ok && err == nil {
+				t.Fatalf("handshake accepted, got job %d", job.Index)
+			}
+		})
+	}
+	miners := n.Miners()
+	if len(miners) != 1 || miners[0] != miner.hex {
+		t.Fatalf("miners %v, want only %s", miners, miner.hex)
+	}
+}
+
+func TestHandshakeJobs(t *testing.T) {
+	n, srv := NewServer()
+	defer srv.Close()
+	defer n.Close()
+	miner := newTestMiner()
+	n.Push(newJob(1, 1, 10))
+	ws := miner.dial(t, srv, 1, time.Now(), miner)
+	defer ws.Close()
+	for _, index := range []uint64{1, 2, 3} {
+		if index > 1 {
+			n.Push(newJob(1, index, 10))
+		}
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var job Job
+		if err := websocket.JSON.Receive(ws, &job); err != nil {
+			t.Fatal(err)
+		}
+		if job.Index != index {
+			t.Fatalf("got job %d, want %d", job.Index, index)
+		}
+	}
+}
+
+func getData(t *testing.T, srv *httptest.Server, chain uint64, structName, key string, raw bool) (int, []byte) {
+	query := url.Values{}
+	query.Set("app_name", CoreApp)
+	query.Set("is_db_data", "true")
+	query.Set("struct_name", structName)
+	query.Set("key", key)
+	if raw {
+		query.Set("raw", "true")
+	}
+	resp, err := http.Get(fmt.Sprintf("%s/api/v1/%d/data?%s", srv.URL, chain, query.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body
+}
+
+func TestData(t *testing.T) {
+	n, srv := NewServer()
+	defer srv.Close()
+	defer n.Close()
+	miner := newTestMiner()
+	n.SetCoins(1, miner.hex, 1234)
+	n.SetMiner(1, miner.hex)
+	n.SetMiningStat(1, miner.hex, 7)
+
+	cases := []struct {
+		structName string
+		key        string
+		want       []byte
+	}{
+		{"dbCoin", miner.hex, encodeUint64(1234)},
+		{"dbMiner", miner.hex, minerRecord{1, 0, miner.addr}.encode()},
+		{"statMining", miner.hex, encodeUint64(7)},
+		{"dbCoin", strings.ToUpper(miner.hex), encodeUint64(1234)},
+		{"dbCoin", newTestMiner().hex, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.structName+"/"+c.key[:8], func(t *testing.T) {
+			status, body := getData(t, srv, 1, c.structName, c.key, true)
+			if status != http.StatusOK || !bytes.Equal(body, c.want) {
+				t.Fatalf("raw: status %d, value %x, want %x", status, body, c.want)
+			}
+
+			status, body = getData(t, srv, 1, c.structName, c.key, false)
+			var info DataInfo
+			if err := json.Unmarshal(body, &info); status != http.StatusOK || err != nil {
+				t.Fatalf("json: status %d, %v: %s", status, err, body)
+			}
+			if info.Value != hex.EncodeToString(c.want) || info.StructName != c.structName {
+				t.Fatalf("json: %+v, want value %x", info, c.want)
+			}
+			if (info.Life > 0) != (len(c.want) > 0) {
+				t.Fatalf("json: life %d for value %x", info.Life, c.want)
+			}
+		})
+	}
+
+	if status, _ := getData(t, srv, 1, "dbCoin", "not hex", true); status != http.StatusBadRequest {
+		t.Fatalf("invalid key: status %d", status)
+	}
+}
+
+func postBlock(t *testing.T, srv *httptest.Server, chain uint64, key, data []byte) (int, string) {
+	u := fmt.Sprintf("%s/api/v1/%d/data?key=%x&broadcast=true", srv.URL, chain, key)
+	resp, err := http.Post(u, "application/octet-stream", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestPostBlock(t *testing.T) {
+	miner := newTestMiner()
+	other := newTestMiner()
+
+	cases := []struct {
+		name   string
+		post   func(t *testing.T, job Job) ([]byte, []byte)
+		reason string
+	}{
+		{"valid", func(t *testing.T, job Job) ([]byte, []byte) {
+			key, data := miner.solve(t, job, job.HashpowerLimit)
+			return key[:], data
+		}, ""},
+		{"hash power too low", func(t *testing.T, job Job) ([]byte, []byte) {
+			job.HashpowerLimit = 0
+			key, data := miner.solve(t, job, 0)
+			for hashPower(key[:]) >= 2 {
+				job.Time++
+				key, data = miner.solve(t, job, 0)
+			}
+			return key[:], data
+		}, "hash power"},
+		{"not the current job", func(t *testing.T, job Job) ([]byte, []byte) {
+			job.Index++
+			key, data := miner.solve(t, job, 2)
+			return key[:], data
+		}, "not the current job"},
+		{"key is not the hash", func(t *testing.T, job Job) ([]byte, []byte) {
+			_, data := miner.solve(t, job, 2)
+			return make([]byte, 32), data
+		}, "key is not the hash"},
+		{"signed by another wallet", func(t *testing.T, job Job) ([]byte, []byte) {
+			block := job.Block
+			block.Producer = miner.addr
+			data := other.signed(encode(t, block))
+			return wallet.GetHash(data), data
+		}, "bad signature"},
+		{"short data", func(t *testing.T, job Job) ([]byte, []byte) {
+			data := []byte{65, 1, 2, 3}
+			return wallet.GetHash(data), data
+		}, "short"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n, srv := NewServer()
+			defer srv.Close()
+			defer n.Close()
+			n.AutoAdvance = true
+			job := newJob(1, 9, 2)
+			n.Push(job)
+
+			key, data := c.post(t, job)
+			status, body := postBlock(t, srv, 1, key, data)
+			posted := n.Posted()
+			if len(posted) != 1 {
+				t.Fatalf("%d blocks recorded", len(posted))
+			}
+			current, _ := n.Current(1)
+			if c.reason == "" {
+				if status != http.StatusOK || !posted[0].Valid {
+					t.Fatalf("refused: %d %s", status, body)
+				}
+				if current.Index != 10 || !bytes.Equal(current.Previous[:], key) {
+					t.Fatalf("the node did not advance to the block, current %d", current.Index)
+				}
+				return
+			}
+			if status != http.StatusBadRequest || posted[0].Valid || !strings.Contains(posted[0].Reason, c.reason) {
+				t.Fatalf("status %d, reason %q, want %q", status, posted[0].Reason, c.reason)
+			}
+			if current.Index != 9 {
+				t.Fatalf("the node advanced to %d on a refused block", current.Index)
+			}
+		})
+	}
+}
+
+// transaction a signed transfer of cost to payee, the data to send and its key
+func (m testMiner) transfer(t *testing.T, chain uint64, payee Address, cost uint64, at time.Time) ([]byte, []byte) {
+	head := TransactionHead{
+		Time:   uint64(at.UnixNano() / 1000000),
+		User:   m.addr,
+		Chain:  chain,
+		Energy: 1000,
+		Cost:   cost,
+		Ops:    opsTransfer,
+	}
+	data := m.signed(append(encode(t, head), payee[:]...))
+	return data, wallet.GetHash(data)
+}
+
+func TestNewTransaction(t *testing.T) {
+	n, srv := NewServer()
+	defer srv.Close()
+	defer n.Close()
+	n.Push(newJob(1, 1, 10))
+	miner := newTestMiner()
+	payee := newTestMiner()
+	n.SetCoins(1, miner.hex, 1000)
+
+	send := func(chain uint64, data []byte) int {
+		resp, err := http.Post(fmt.Sprintf("%s/api/v1/%d/transaction/new", srv.URL, chain), "application/octet-stream", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	info := func(key []byte) int {
+		resp, err := http.Get(fmt.Sprintf("%s/api/v1/1/transaction/info?key=%x", srv.URL, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	data, key := miner.transfer(t, 1, payee.addr, 300, time.Now().Add(-time.Minute))
+	if status := send(1, data); status != http.StatusOK {
+		t.Fatalf("transfer refused: %d", status)
+	}
+	if status := info(key); status != http.StatusNotFound {
+		t.Fatalf("transaction info before the block: %d", status)
+	}
+
+	// refused: another chain, a future time, a broken signature
+	wrongChain, _ := miner.transfer(t, 2, payee.addr, 1, time.Now().Add(-time.Minute))
+	future, _ := miner.transfer(t, 1, payee.addr, 1, time.Now().Add(time.Hour))
+	broken, _ := miner.transfer(t, 1, payee.addr, 1, time.Now().Add(-time.Minute))
+	broken[5] ^= 0xff
+	for name, bad := range map[string][]byte{"wrong chain": wrongChain, "future": future, "broken": broken, "short": {1}} {
+		if status := send(1, bad); status != http.StatusBadRequest {
+			t.Errorf("%s: status %d", name, status)
+		}
+	}
+
+	n.Push(newJob(1, 2, 10))
+	if status := info(key); status != http.StatusOK {
+		t.Fatalf("transaction info after the block: %d", status)
+	}
+	tr, ok := n.Transaction(1, key)
+	if !ok || tr.BlockID != 1 || tr.Reason != "" {
+		t.Fatalf("transaction %+v", tr)
+	}
+	if got := n.GetData(1, "", "dbCoin", payee.hex); !bytes.Equal(got, encodeUint64(300)) {
+		t.Fatalf("balance of the payee %x", got)
+	}
+	if got := n.GetData(1, "", "dbCoin", miner.hex); !bytes.Equal(got, encodeUint64(700)) {
+		t.Fatalf("balance of the miner %x", got)
+	}
+}
+
+// miningSubs the number of mining websockets of the chain that are still served
+func (n *Node) miningSubs(chain uint64) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.subs[chain])
+}
+
+func waitSubs(t *testing.T, n *Node, chain uint64, want int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for n.miningSubs(chain) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d websockets served, want %d", n.miningSubs(chain), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHangAfter(t *testing.T) {
+	n, srv := NewServer()
+	defer srv.Close()
+	defer n.Close()
+	n.SetFaults(Faults{HangAfter: 1})
+	n.Push(newJob(1, 1, 10))
+	miner := newTestMiner()
+
+	// the hung websocket ends once the miner goes away
+	ws := miner.dial(t, srv, 1, time.Now(), miner)
+	var job Job
+	if err := websocket.JSON.Receive(ws, &job); err != nil {
+		t.Fatal(err)
+	}
+	waitSubs(t, n, 1, 1)
+	ws.Close()
+	waitSubs(t, n, 1, 0)
+
+	// or once the node is closed
+	ws = miner.dial(t, srv, 1, time.Now(), miner)
+	defer ws.Close()
+	if err := websocket.JSON.Receive(ws, &job); err != nil {
+		t.Fatal(err)
+	}
+	n.Push(newJob(1, 2, 10))
+	ws.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if err := websocket.JSON.Receive(ws, &job); err == nil {
+		t.Fatalf("got job %d from a hung websocket", job.Index)
+	}
+	n.Close()
+	waitSubs(t, n, 1, 0)
+}
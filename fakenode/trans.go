@@ -0,0 +1,288 @@
+package fakenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lengzhao/govm/wallet"
+)
+
+// operations of transactions that the node applies, the others are only recorded
+const (
+	opsTransfer      = uint8(0)
+	opsRegisterMiner = uint8(6)
+)
+
+// TransactionHead transaction = sign + head + data
+type TransactionHead struct {
+	Time   uint64
+	User   Address
+	Chain  uint64
+	Energy uint64
+	Cost   uint64
+	Ops    uint8
+}
+
+// Transaction a transaction sent to the node
+type Transaction struct {
+	TransactionHead
+	Key  []byte
+	Data []byte
+	// BlockID the index of the block that included it, 0 while pending
+	BlockID uint64
+	// Reason why it was dropped instead of included
+	Reason string
+}
+
+// BlockInfo the answer of block/info, like the node
+type BlockInfo struct {
+	Time     uint64 `json:"time,omitempty"`
+	Previous string `json:"previous,omitempty"`
+	Producer string `json:"producer,omitempty"`
+	Chain    uint64 `json:"chain,omitempty"`
+	Index    uint64 `json:"index,omitempty"`
+	Key      string `json:"key,omitempty"`
+}
+
+// transInfo the answer of transaction/info, like the node
+type transInfo struct {
+	TransactionHead
+	Key    []byte
+	Size   int
+	Others map[string]interface{}
+}
+
+type regMiner struct {
+	Chain uint64
+	Index uint64
+}
+
+// minerRecord the value of dbMiner, like core.syncRegMiner
+type minerRecord struct {
+	Index uint64
+	Cost  uint64
+	User  Address
+}
+
+func (r minerRecord) encode() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, r)
+	return buf.Bytes()
+}
+
+// SetGuerdon set the guerdon of the chain, miners must register with 3 times of it
+func (n *Node) SetGuerdon(chain, guerdon uint64) {
+	n.SetData(chain, "", "dbStat", "02", encodeUint64(guerdon))
+}
+
+// Transaction the transaction with the key on the chain
+func (n *Node) Transaction(chain uint64, key []byte) (Transaction, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	t := n.trans[chain][hex.EncodeToString(key)]
+	if t == nil {
+		return Transaction{}, false
+	}
+	return *t, true
+}
+
+// unsafeSealBlock must be called with n.mu held. The job became a block with
+// the key, the pending transactions of its chain go into it.
+func (n *Node) unsafeSealBlock(job *Job, key Hash) {
+	info := BlockInfo{
+		Time:     job.Time,
+		Previous: hex.EncodeToString(job.Previous[:]),
+		Chain:    job.Chain,
+		Index:    job.Index,
+		Key:      hex.EncodeToString(key[:]),
+	}
+	for _, p := range n.posted {
+		if p.Valid && bytes.Equal(p.Key, key[:]) {
+			info.Producer = hex.EncodeToString(p.Block.Producer[:])
+		}
+	}
+	if n.blocks[job.Chain] == nil {
+		n.blocks[job.Chain] = make(map[uint64]BlockInfo)
+	}
+	n.blocks[job.Chain][job.Index] = info
+
+	for _, t := range n.pending[job.Chain] {
+		if t.Reason = n.unsafeApply(t); t.Reason != "" {
+			log.Printf("transaction %x dropped: %s\n", t.Key, t.Reason)
+			continue
+		}
+		t.BlockID = job.Index
+	}
+	n.pending[job.Chain] = nil
+}
+
+func (n *Node) unsafeUint64(chain uint64, structName, key string) uint64 {
+	val := n.data[chain][dataKey("", structName, key)]
+	if len(val) < 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(val)
+}
+
+func (n *Node) unsafeSetUint64(chain uint64, structName, key string, v uint64) {
+	n.unsafeSetData(chain, structName, key, encodeUint64(v))
+}
+
+func (n *Node) unsafeSetData(chain uint64, structName, key string, val []byte) {
+	if n.data[chain] == nil {
+		n.data[chain] = make(map[string][]byte)
+	}
+	n.data[chain][dataKey("", structName, key)] = val
+}
+
+// unsafeApply must be called with n.mu held, return why the transaction fails
+func (n *Node) unsafeApply(t *Transaction) string {
+	user := hex.EncodeToString(t.User[:])
+	coins := n.unsafeUint64(t.Chain, "dbCoin", user)
+	if coins < t.Cost {
+		return fmt.Sprintf("not enough coins, have:%d cost:%d", coins, t.Cost)
+	}
+	switch t.Ops {
+	case opsTransfer:
+		if len(t.Data) != len(Address{}) {
+			return "error payee"
+		}
+		payee := hex.EncodeToString(t.Data)
+		n.unsafeSetUint64(t.Chain, "dbCoin", user, coins-t.Cost)
+		n.unsafeSetUint64(t.Chain, "dbCoin", payee, n.unsafeUint64(t.Chain, "dbCoin", payee)+t.Cost)
+	case opsRegisterMiner:
+		var info regMiner
+		if binary.Read(bytes.NewReader(t.Data), binary.BigEndian, &info) != nil {
+			return "error miner info"
+		}
+		if guerdon := n.unsafeUint64(t.Chain, "dbStat", "02"); t.Cost < 3*guerdon {
+			return fmt.Sprintf("cost %d lower than 3 times of the guerdon %d", t.Cost, guerdon)
+		}
+		var current uint64
+		if job := n.jobs[t.Chain]; job != nil {
+			current = job.Index
+		}
+		if info.Index <= current+20 {
+			return fmt.Sprintf("index %d is too close to %d", info.Index, current)
+		}
+		n.unsafeSetUint64(t.Chain, "dbCoin", user, coins-t.Cost)
+		n.unsafeSetData(t.Chain, "dbMiner", user, minerRecord{info.Index, t.Cost, t.User}.encode())
+	default:
+		n.unsafeSetUint64(t.Chain, "dbCoin", user, coins-t.Cost)
+	}
+	return ""
+}
+
+// serveNewTransaction check the signature of the transaction and keep it until the next block
+func (n *Node) serveNewTransaction(chain uint64, w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "fail to read body of request,", err)
+		return
+	}
+	headLen := binary.Size(TransactionHead{})
+	if len(data) < 1 || len(data) < 1+int(data[0])+headLen {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("error:short transaction"))
+		return
+	}
+	signLen := int(data[0])
+	sign := data[1 : 1+signLen]
+	body := data[1+signLen:]
+	t := &Transaction{Key: wallet.GetHash(data), Data: body[headLen:]}
+	binary.Read(bytes.NewReader(body), binary.BigEndian, &t.TransactionHead)
+	now := uint64(n.Now().UnixNano() / 1000000)
+	switch {
+	case t.Chain != chain:
+		err = fmt.Errorf("error chain %d", t.Chain)
+	case t.Time > now || t.Time+uint64(10*24*time.Hour/time.Millisecond) < now:
+		err = fmt.Errorf("error time %d", t.Time)
+	case !wallet.Recover(t.User[:], sign, body):
+		err = fmt.Errorf("bad signature of the user")
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error:%s", err)
+		return
+	}
+
+	n.mu.Lock()
+	k := hex.EncodeToString(t.Key)
+	if n.trans[chain] == nil {
+		n.trans[chain] = make(map[string]*Transaction)
+	}
+	if n.trans[chain][k] == nil {
+		n.trans[chain][k] = t
+		n.pending[chain] = append(n.pending[chain], t)
+	}
+	n.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveTransactionInfo the transaction once a block includes it, not found before
+func (n *Node) serveTransactionInfo(chain uint64, w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	key, err := hex.DecodeString(r.Form.Get("key"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("error key"))
+		return
+	}
+	t, ok := n.Transaction(chain, key)
+	if !ok || t.BlockID == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "error key.chain:%d,key:%x", chain, key)
+		return
+	}
+	info := transInfo{TransactionHead: t.TransactionHead, Key: t.Key, Size: len(t.Data)}
+	info.Others = map[string]interface{}{"BlockID": t.BlockID}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(info)
+}
+
+// serveBlockInfo the block of the index on the main chain, the last block without index
+func (n *Node) serveBlockInfo(chain uint64, w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	var index uint64
+	if s := r.Form.Get("index"); s != "" {
+		var err error
+		if index, err = strconv.ParseUint(s, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("error index"))
+			return
+		}
+	}
+	n.mu.Lock()
+	if index == 0 {
+		for i := range n.blocks[chain] {
+			if i > index {
+				index = i
+			}
+		}
+	}
+	info, ok := n.blocks[chain][index]
+	if job := n.jobs[chain]; !ok && job != nil && (index == 0 || index+1 == job.Index) {
+		// nothing sealed yet, the last block is the one the job builds on
+		info = BlockInfo{Chain: chain, Index: job.Index - 1, Key: hex.EncodeToString(job.Previous[:])}
+		ok = true
+	}
+	n.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "error key.chain:%d,index:%d\n", chain, index)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lengzhao/govm/wallet"
+	"golang.org/x/net/websocket"
+)
+
+// fanoutSession a miner on the LAN that gets the jobs of one chain
+type fanoutSession struct {
+	chain uint64
+	addr  Address
+	jobs  chan RespBlock
+}
+
+var fanoutMu sync.Mutex
+var fanoutSessions map[*fanoutSession]bool
+
+// fanoutRelayed the keys of the recently relayed solutions, to drop duplicates
+var fanoutRelayed map[string]time.Time
+
+func init() {
+	fanoutSessions = make(map[*fanoutSession]bool)
+	fanoutRelayed = make(map[string]time.Time)
+}
+
+// startFanout re-serve the jobs of the upstream connections on conf.FanoutListen,
+// so miners on the LAN can use this process as their server
+func startFanout() error {
+	ln, err := net.Listen("tcp", conf.FanoutListen)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(serveFanout)}
+	go func() {
+		log.Fatalln("fanout server stopped:", srv.Serve(ln))
+	}()
+	go refreshFanoutJobs()
+	fmt.Println("fanout listening on", conf.FanoutListen)
+	return nil
+}
+
+// serveFanout the subset of the node API that miners use: /api/v1/{chain}/ws/mining and /data
+func serveFanout(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 4 || parts[0] != "api" || parts[1] != "v1" {
+		http.NotFound(w, r)
+		return
+	}
+	chain, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("error chain"))
+		return
+	}
+	served := false
+	for _, c := range activeChains() {
+		if c == chain {
+			served = true
+		}
+	}
+	if !served {
+		http.NotFound(w, r)
+		return
+	}
+	route := strings.Join(parts[3:], "/")
+	switch {
+	case route == "ws/mining":
+		s := websocket.Server{Handler: func(ws *websocket.Conn) { serveFanoutMining(chain, ws) }}
+		s.ServeHTTP(w, r)
+	case route == "data" && r.Method == http.MethodGet:
+		relayData(chain, w, r)
+	case route == "data" && r.Method == http.MethodPost:
+		relaySolution(chain, w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// fanoutUpstream the server that delivered the current job of the chain
+func fanoutUpstream(chain uint64) string {
+	mu.Lock()
+	defer mu.Unlock()
+	if block := blocks[chain]; block != nil {
+		return block.From
+	}
+	return conf.Servers[0]
+}
+
+// serveFanoutMining check the signed wsHead of the miner like a node does,
+// then push it every new job with the miner as producer
+func serveFanoutMining(chain uint64, ws *websocket.Conn) {
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 256)
+	n, err := ws.Read(buf)
+	if err != nil {
+		return
+	}
+	headLen := binary.Size(wsHead{})
+	head := wsHead{}
+	if n <= headLen || Decode(buf[:headLen], &head) == 0 {
+		log.Println("fanout: invalid handshake from", ws.Request().RemoteAddr)
+		return
+	}
+	if !wallet.Recover(head.Addr[:], buf[headLen:n], buf[:headLen]) {
+		log.Println("fanout: bad signature from", ws.Request().RemoteAddr)
+		return
+	}
+	if d := nodeNow().Sub(time.Unix(head.Time, 0)); d > 5*time.Minute || d < -5*time.Minute {
+		log.Printf("fanout: handshake time of %s is off by %s\n", ws.Request().RemoteAddr, d)
+		return
+	}
+	ws.SetReadDeadline(time.Time{})
+
+	s := &fanoutSession{chain: chain, addr: head.Addr, jobs: make(chan RespBlock, 4)}
+	fanoutMu.Lock()
+	fanoutSessions[s] = true
+	fanoutMu.Unlock()
+	if conf.Verbosity >= 3 {
+		log.Printf("fanout: miner %x joined from %s, chain:%d\n", head.Addr, ws.Request().RemoteAddr, chain)
+	}
+	defer func() {
+		fanoutMu.Lock()
+		delete(fanoutSessions, s)
+		fanoutMu.Unlock()
+		if conf.Verbosity >= 3 {
+			log.Printf("fanout: miner %x left, chain:%d\n", head.Addr, chain)
+		}
+	}()
+
+	// the miner sends nothing after the handshake, reading only notices the close
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var b [64]byte
+		for {
+			if _, err := ws.Read(b[:]); err != nil {
+				return
+			}
+		}
+	}()
+
+	mu.Lock()
+	current := blocks[chain]
+	mu.Unlock()
+	if current != nil {
+		s.jobs <- fanoutJob(current, s.addr)
+	}
+	for {
+		select {
+		case <-closed:
+			return
+		case job := <-s.jobs:
+			ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err = websocket.JSON.Send(ws, job); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// fanoutJob the job as a node would send it to the miner
+func fanoutJob(block *RespBlockWithKey, producer Address) RespBlock {
+	job := RespBlock{Block: block.Block, HashpowerLimit: block.HashpowerLimit}
+	job.Producer = producer
+	return job
+}
+
+// refreshFanoutJobs push every new job of the upstream connections to the miners, once
+func refreshFanoutJobs() {
+	seen := make(map[uint64]Block)
+	for {
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		var changed []RespBlockWithKey
+		for c, block := range blocks {
+			if block == nil {
+				continue
+			}
+			// the job of another server with the same block is a duplicate
+			b := block.Block
+			b.Producer = Address{}
+			b.Nonce = 0
+			if seen[c] != b {
+				seen[c] = b
+				changed = append(changed, *block)
+			}
+		}
+		mu.Unlock()
+
+		fanoutMu.Lock()
+		for i := range changed {
+			block := &changed[i]
+			for s := range fanoutSessions {
+				if s.chain != block.Chain {
+					continue
+				}
+				select {
+				case s.jobs <- fanoutJob(block, s.addr):
+				default:
+					log.Printf("fanout: miner %x is too slow, job dropped, chain:%d index:%d\n", s.addr, block.Chain, block.Index)
+				}
+			}
+		}
+		fanoutMu.Unlock()
+	}
+}
+
+// relayData answer a data query with the answer of the upstream server
+func relayData(chain uint64, w http.ResponseWriter, r *http.Request) {
+	c := NewNodeClient(fanoutUpstream(chain))
+	data, _, err := c.do(r.Context(), http.MethodGet, r.URL.Path, r.URL.Query(), nil)
+	writeRelayed(w, data, err)
+}
+
+// relaySolution post the solution of a miner upstream according to conf.SubmitStrategy
+func relaySolution(chain uint64, w http.ResponseWriter, r *http.Request) {
+	key, err := hex.DecodeString(r.URL.Query().Get("key"))
+	if err != nil || len(key) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("error key"))
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	k := hex.EncodeToString(key)
+	fanoutMu.Lock()
+	for old, t := range fanoutRelayed {
+		if time.Since(t) > 10*time.Minute {
+			delete(fanoutRelayed, old)
+		}
+	}
+	_, dup := fanoutRelayed[k]
+	fanoutRelayed[k] = time.Now()
+	fanoutMu.Unlock()
+	if dup {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// not a block of this process, keep it out of the submission stats and scores
+	sub := postSolution(chain, fanoutUpstream(chain), key, data)
+	if sub.First != "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	// nobody took it, let the miner try again
+	fanoutMu.Lock()
+	delete(fanoutRelayed, k)
+	fanoutMu.Unlock()
+	err = errors.New("no server")
+	if len(sub.Results) > 0 {
+		err = sub.Results[0].Err
+	}
+	writeRelayed(w, nil, err)
+}
+
+// writeRelayed answer like the upstream server did
+func writeRelayed(w http.ResponseWriter, data []byte, err error) {
+	var se *ServerError
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+	case err == ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	case errors.As(err, &se):
+		w.WriteHeader(se.Status)
+		w.Write([]byte(se.Body))
+	case errors.Is(err, context.Canceled):
+		// the miner went away
+	default:
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(err.Error()))
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gomv-net/mining/fakenode"
+)
+
+// requestBlockFor run requestBlock until it returns or d passed
+func requestBlockFor(chain uint64, server string, d time.Duration) (bool, error, time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	start := time.Now()
+	connected, err := requestBlock(ctx, chain, server, new(connSlot))
+	return connected, err, time.Since(start)
+}
+
+func TestFaults(t *testing.T) {
+	cases := []struct {
+		name   string
+		faults fakenode.Faults
+		check  func(t *testing.T, n *fakenode.Node, server string, chain uint64)
+	}{
+		{"TruncateRaw", fakenode.Faults{TruncateRaw: true}, func(t *testing.T, n *fakenode.Node, server string, chain uint64) {
+			n.SetCoins(chain, userAddrStr, 5*govmUnit)
+			n.SetMiningStat(chain, userAddrStr, 3)
+			n.SetGuerdon(chain, 7)
+			c := NewNodeClient(server)
+			if coins, err := getCoins(context.Background(), c, chain, userAddrStr); err == nil {
+				t.Fatalf("truncated balance taken as %d", coins)
+			}
+			if guerdon, err := getGuerdon(context.Background(), c, chain); err == nil {
+				t.Fatalf("truncated guerdon taken as %d", guerdon)
+			}
+			var stat MiningStat
+			if err := getCoreData(context.Background(), c, chain, "statMining", userAddrStr, &stat); err == nil {
+				t.Fatalf("truncated mining stat taken as %d", stat.Blocks)
+			}
+			// shorter than the 20 bytes that Decode logs
+			var v uint64
+			if Decode([]byte{1, 2, 3}, &v) != 0 {
+				t.Fatal("Decode of 3 bytes into an uint64 succeeded")
+			}
+		}},
+		{"MalformedJSON", fakenode.Faults{MalformedJSON: true}, func(t *testing.T, n *fakenode.Node, server string, chain uint64) {
+			n.SetMiner(chain, userAddrStr)
+			if _, err := NewNodeClient(server).DataInfo(context.Background(), chain, "", "dbMiner", userAddrStr); err == nil {
+				t.Fatal("malformed data info taken")
+			} else if _, ok := err.(*ServerError); !ok {
+				t.Fatalf("error %T %v, want ServerError", err, err)
+			}
+			if ok, err := isMiner(chain, server, userAddrStr); err == nil {
+				t.Fatalf("isMiner answered %t from malformed json", ok)
+			}
+			// every job comes after a broken frame, the jobs still count
+			n.Push(testJob(chain, 5))
+			cancel, _ := runRequestBlock(chain, server)
+			defer cancel()
+			waitJob(t, chain, 5)
+			n.Push(testJob(chain, 6))
+			n.Push(testJob(chain, 7))
+			waitJob(t, chain, 7)
+		}},
+		{"OutOfOrder", fakenode.Faults{OutOfOrder: true}, func(t *testing.T, n *fakenode.Node, server string, chain uint64) {
+			n.Push(testJob(chain, 5))
+			cancel, _ := runRequestBlock(chain, server)
+			defer cancel()
+			waitJob(t, chain, 5)
+			n.Push(testJob(chain, 6))
+			waitJob(t, chain, 6)
+			// the older job sent after 6 is no rollback within forkGrace
+			time.Sleep(500 * time.Millisecond)
+			waitJob(t, chain, 6)
+		}},
+		{"Duplicate", fakenode.Faults{Duplicate: true}, func(t *testing.T, n *fakenode.Node, server string, chain uint64) {
+			n.Push(testJob(chain, 5))
+			cancel, _ := runRequestBlock(chain, server)
+			defer cancel()
+			first := waitJob(t, chain, 5)
+			time.Sleep(200 * time.Millisecond)
+			if again := waitJob(t, chain, 5); again != first {
+				t.Fatal("the duplicate replaced the job")
+			}
+			n.Push(testJob(chain, 6))
+			waitJob(t, chain, 6)
+		}},
+		{"Delay", fakenode.Faults{Delay: 1500 * time.Millisecond}, func(t *testing.T, n *fakenode.Node, server string, chain uint64) {
+			start := time.Now()
+			_, err := NewNodeClient(server).Data(context.Background(), chain, "", "dbCoin", userAddrStr)
+			if _, ok := err.(*UnreachableError); !ok {
+				t.Fatalf("error %T %v, want UnreachableError after the request timeout", err, err)
+			}
+			if d := time.Since(start); d > 1400*time.Millisecond {
+				t.Fatalf("the request took %s, the timeout is 1s", d)
+			}
+			// slow jobs are not a dead connection, pongs still come
+			n.Push(testJob(chain, 5))
+			cancel, done := runRequestBlock(chain, server)
+			defer cancel()
+			waitJob(t, chain, 5)
+			n.Push(testJob(chain, 6))
+			waitJob(t, chain, 6)
+			select {
+			case err := <-done:
+				t.Fatal("requestBlock returned:", err)
+			default:
+			}
+		}},
+		{"DisconnectAfter", fakenode.Faults{DisconnectAfter: 1}, func(t *testing.T, n *fakenode.Node, server string, chain uint64) {
+			n.Push(testJob(chain, 5))
+			connected, err, d := requestBlockFor(chain, server, 10*time.Second)
+			if !connected || err == nil || err == errHalfOpen || d > 5*time.Second {
+				t.Fatalf("connected:%t, %v after %s, want a closed connection", connected, err, d)
+			}
+			waitJob(t, chain, 5)
+		}},
+		{"HangAfter", fakenode.Faults{HangAfter: 1}, func(t *testing.T, n *fakenode.Node, server string, chain uint64) {
+			n.Push(testJob(chain, 5))
+			// keepalive_sec + keepalive_timeout_sec is 2s
+			connected, err, d := requestBlockFor(chain, server, 10*time.Second)
+			if !connected || err != errHalfOpen || d > 4*time.Second {
+				t.Fatalf("connected:%t, %v after %s, want %v", connected, err, d, errHalfOpen)
+			}
+			waitJob(t, chain, 5)
+		}},
+	}
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n, server, closeNode := newTestNode(c.faults)
+			defer closeNode()
+			setupTest(t, map[string]interface{}{"request_timeout_sec": 1}, server)
+			c.check(t, n, server, uint64(100+i))
+		})
+	}
+}
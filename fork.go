@@ -0,0 +1,305 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// forkGrace how long the servers get to agree again. Most servers lag behind
+// a new higher tip for a moment only, if they stay on another tip for longer
+// the higher one is taken for a fork or for a node that missed a rollback.
+const forkGrace = 15 * time.Second
+
+// serverTip the last job of a connected server
+type serverTip struct {
+	Job *RespBlockWithKey
+	// Since when the server is on this tip
+	Since time.Time
+	// Flagged the hash power limit of the tip was counted as a disagreement already
+	Flagged bool
+	// Lower a job below Job, it replaces Job if the server sends nothing
+	// higher for forkGrace and sent more than one lower job, or other servers
+	// are on it: the node rolled back. Else it was only late and is dropped.
+	Lower      *RespBlockWithKey
+	LowerSince time.Time
+	LowerJobs  int
+}
+
+// tipGroup the servers that are on the same index and parent
+type tipGroup struct {
+	Job     *RespBlockWithKey
+	Votes   int
+	Score   float64
+	Since   time.Time
+	Members []*serverTip
+	// Agreed ConsensusServers servers are on it
+	Agreed bool
+}
+
+// tips the tip of every connected server, per chain. Guarded by mu
+var tips map[uint64]map[string]*serverTip
+
+// disagreeSince when most servers stopped being on the highest tip, per chain. Guarded by mu
+var disagreeSince map[uint64]time.Time
+
+// disagreeing since when the servers are on tips that too few servers agree on,
+// per chain. Guarded by mu
+var disagreeing map[uint64]map[string]time.Time
+
+func init() {
+	tips = make(map[uint64]map[string]*serverTip)
+	disagreeSince = make(map[uint64]time.Time)
+	disagreeing = make(map[uint64]map[string]time.Time)
+}
+
+func sameTip(a, b *RespBlockWithKey) bool {
+	return a.Index == b.Index && a.Previous == b.Previous
+}
+
+// unsafeSetTip must be called with mu held, the server sent the job
+func unsafeSetTip(chain uint64, server string, job *RespBlockWithKey) {
+	if tips[chain] == nil {
+		tips[chain] = make(map[string]*serverTip)
+	}
+	old := tips[chain][server]
+	switch {
+	case old == nil || job.Index > old.Job.Index:
+		tips[chain][server] = &serverTip{Job: job, Since: time.Now()}
+	case sameTip(old.Job, job):
+		old.Job = job
+		old.Lower = nil
+	case job.Index == old.Job.Index:
+		// the node moved to another parent
+		tips[chain][server] = &serverTip{Job: job, Since: time.Now()}
+	case old.Lower == nil:
+		old.Lower = job
+		old.LowerSince = time.Now()
+		old.LowerJobs = 1
+	default:
+		old.Lower = job
+		old.LowerJobs++
+	}
+}
+
+// unsafeDropTip must be called with mu held, the server is disconnected
+func unsafeDropTip(chain uint64, server string) {
+	delete(tips[chain], server)
+}
+
+// unsafeOthersOn must be called with mu held, whether a server other than
+// server is on the tip of job
+func unsafeOthersOn(chain uint64, server string, job *RespBlockWithKey) bool {
+	for s, t := range tips[chain] {
+		if s != server && sameTip(t.Job, job) {
+			return true
+		}
+	}
+	return false
+}
+
+// unsafeTipGroups must be called with mu held, the tips of the chain grouped
+// by index and parent. The job of a group has the hash power limit that most
+// of its servers sent, the servers that sent another one are flagged.
+func unsafeTipGroups(chain uint64) []*tipGroup {
+	var groups []*tipGroup
+	for server, t := range tips[chain] {
+		if t.Lower != nil && time.Since(t.LowerSince) >= forkGrace {
+			if t.LowerJobs > 1 || unsafeOthersOn(chain, server, t.Lower) {
+				log.Printf("chain:%d, %s rolled back from index %d to %d\n", chain, server, t.Job.Index, t.Lower.Index)
+				t.Job, t.Since, t.Flagged = t.Lower, t.LowerSince, false
+			} else if conf.Verbosity >= 3 {
+				log.Printf("chain:%d, %s sent a single stale job of index %d, ignored\n", chain, server, t.Lower.Index)
+			}
+			t.Lower, t.LowerJobs = nil, 0
+		}
+		var g *tipGroup
+		for _, it := range groups {
+			if sameTip(it.Job, t.Job) {
+				g = it
+				break
+			}
+		}
+		if g == nil {
+			g = &tipGroup{Job: t.Job, Since: t.Since, Score: -1}
+			groups = append(groups, g)
+		}
+		g.Votes++
+		g.Members = append(g.Members, t)
+		if t.Since.Before(g.Since) {
+			g.Since = t.Since
+		}
+		if s := serverScore(server); s > g.Score {
+			g.Score = s
+			g.Job = t.Job
+		}
+	}
+
+	for _, g := range groups {
+		g.Agreed = conf.ConsensusServers <= 1 || g.Votes >= conf.ConsensusServers
+		if len(g.Members) < 2 {
+			continue
+		}
+		limits := make(map[uint64]int)
+		for _, t := range g.Members {
+			limits[t.Job.HashpowerLimit]++
+		}
+		var limit uint64
+		for l, n := range limits {
+			if n > limits[limit] || n == limits[limit] && l > limit {
+				limit = l
+			}
+		}
+		if g.Job.HashpowerLimit == limit {
+			continue
+		}
+		for _, t := range g.Members {
+			if t.Job.HashpowerLimit == limit {
+				g.Job = t.Job
+				break
+			}
+		}
+		for _, t := range g.Members {
+			if t.Job.HashpowerLimit != limit && !t.Flagged {
+				t.Flagged = true
+				recordDisagreement(t.Job.From)
+				log.Printf("chain:%d, %s sent hash power limit %d at index %d, the others %d\n",
+					chain, t.Job.From, t.Job.HashpowerLimit, t.Job.Index, limit)
+			}
+		}
+	}
+	return groups
+}
+
+// unsafeSelectTip must be called with mu held. Only the tips that
+// ConsensusServers servers agree on are mined, or if there is none, the tips
+// older than ConsensusTimeoutSec. Of those the highest, unless most servers
+// stay on another one for forkGrace: then that one. Ties go to the higher
+// index, then to the better scored servers.
+func unsafeSelectTip(chain uint64) *tipGroup {
+	var groups, timedOut []*tipGroup
+	timeout := time.Duration(conf.ConsensusTimeoutSec) * time.Second
+	for _, g := range unsafeTipGroups(chain) {
+		if g.Agreed {
+			groups = append(groups, g)
+		} else if time.Since(g.Since) >= timeout {
+			timedOut = append(timedOut, g)
+		}
+	}
+	if len(groups) == 0 {
+		groups = timedOut
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+
+	highest, majority := groups[0], groups[0]
+	for _, g := range groups[1:] {
+		if g.Job.Index > highest.Job.Index ||
+			g.Job.Index == highest.Job.Index && (g.Votes > highest.Votes || g.Votes == highest.Votes && g.Score > highest.Score) {
+			highest = g
+		}
+		if g.Votes > majority.Votes ||
+			g.Votes == majority.Votes && (g.Job.Index > majority.Job.Index || g.Job.Index == majority.Job.Index && g.Score > majority.Score) {
+			majority = g
+		}
+	}
+	if majority.Votes == highest.Votes {
+		delete(disagreeSince, chain)
+		return highest
+	}
+	since, ok := disagreeSince[chain]
+	if !ok {
+		disagreeSince[chain] = time.Now()
+		return highest
+	}
+	if time.Since(since) < forkGrace {
+		return highest
+	}
+	return majority
+}
+
+// unsafeFlagDisagreements must be called with mu held. The servers that are
+// not behind the agreed tip, but stay on tips that too few servers agree on,
+// are flagged once every ConsensusTimeoutSec.
+func unsafeFlagDisagreements(chain uint64, agreed *tipGroup) {
+	timeout := time.Duration(conf.ConsensusTimeoutSec) * time.Second
+	if disagreeing[chain] == nil {
+		disagreeing[chain] = make(map[string]time.Time)
+	}
+	for server, t := range tips[chain] {
+		votes := 0
+		for _, o := range tips[chain] {
+			if sameTip(o.Job, t.Job) {
+				votes++
+			}
+		}
+		if t.Job.Index < agreed.Job.Index || votes >= conf.ConsensusServers {
+			delete(disagreeing[chain], server)
+			continue
+		}
+		since, ok := disagreeing[chain][server]
+		if !ok {
+			disagreeing[chain][server] = time.Now()
+			continue
+		}
+		if time.Since(since) < timeout {
+			continue
+		}
+		disagreeing[chain][server] = time.Now()
+		recordDisagreement(server)
+		log.Printf("chain:%d, %s disagrees with %d servers, index:%d previous:%x... agreed index:%d previous:%x...\n",
+			chain, server, agreed.Votes, t.Job.Index, t.Job.Previous[:8], agreed.Job.Index, agreed.Job.Previous[:8])
+	}
+	for server := range disagreeing[chain] {
+		if tips[chain][server] == nil {
+			delete(disagreeing[chain], server)
+		}
+	}
+}
+
+// unsafeUpdateJob must be called with mu held. Mine the selected tip of the
+// chain if it is not the current job.
+func unsafeUpdateJob(chain uint64) {
+	g := unsafeSelectTip(chain)
+	if g == nil {
+		return
+	}
+	if conf.ConsensusServers > 1 && g.Agreed {
+		unsafeFlagDisagreements(chain, g)
+	}
+	job := g.Job
+	current := blocks[chain]
+	if current != nil && sameTip(current, job) && current.HashpowerLimit == job.HashpowerLimit &&
+		tips[chain][current.From] != nil {
+		return
+	}
+	if !g.Agreed {
+		log.Printf("chain:%d, no %d servers agree on index %d within %ds, mining the tip of %d\n",
+			chain, conf.ConsensusServers, job.Index, conf.ConsensusTimeoutSec, g.Votes)
+	}
+	if current != nil && !sameTip(current, job) && job.Index <= current.Index {
+		log.Printf("chain:%d, switch to the tip of most servers, index:%d previous:%x... was index:%d previous:%x...\n",
+			chain, job.Index, job.Previous[:8], current.Index, current.Previous[:8])
+	}
+	blocks[chain] = job
+	blockFlag++
+	if conf.Verbosity >= 3 {
+		hashRate, genBlockNum, acceptedNum, confirmationRate := unsafeComputeHashrate()
+		log.Printf("new_block hr=%d, cc=%d, cf=%d (%.1f%%) from:%s chain:%d index:%d hpl:%d previous:%x...\n",
+			hashRate, genBlockNum, acceptedNum, confirmationRate,
+			job.From, job.Chain, job.Index, job.HashpowerLimit, job.Previous[:8])
+	}
+}
+
+// watchTips select the tips again from time to time, a rollback or the end
+// of forkGrace may come without a job. Never returns.
+func watchTips() {
+	for {
+		time.Sleep(forkGrace / 3)
+		mu.Lock()
+		for chain := range tips {
+			unsafeUpdateJob(chain)
+		}
+		mu.Unlock()
+	}
+}
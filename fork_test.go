@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStaleLowerJob(t *testing.T) {
+	const chain = 21
+	job := func(index uint64) *RespBlockWithKey {
+		b := new(RespBlockWithKey)
+		b.Chain = chain
+		b.Index = index
+		b.Previous[0] = byte(index)
+		b.HashpowerLimit = 2
+		return b
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	defer delete(tips, chain)
+
+	// one older job, like the OutOfOrder fault, is only late
+	unsafeSetTip(chain, "a", job(6))
+	unsafeSetTip(chain, "a", job(5))
+	tips[chain]["a"].LowerSince = time.Now().Add(-forkGrace)
+	unsafeTipGroups(chain)
+	if tip := tips[chain]["a"]; tip.Job.Index != 6 || tip.Lower != nil {
+		t.Fatalf("tip %d, lower %v after a single stale job", tip.Job.Index, tip.Lower)
+	}
+
+	// the node keeps sending lower jobs, it rolled back
+	unsafeSetTip(chain, "a", job(4))
+	unsafeSetTip(chain, "a", job(5))
+	tips[chain]["a"].LowerSince = time.Now().Add(-forkGrace)
+	unsafeTipGroups(chain)
+	if tip := tips[chain]["a"]; tip.Job.Index != 5 {
+		t.Fatalf("tip %d after repeated lower jobs, want 5", tip.Job.Index)
+	}
+
+	// another server is on the lower tip
+	unsafeSetTip(chain, "b", job(5))
+	unsafeSetTip(chain, "a", job(7))
+	unsafeSetTip(chain, "a", job(5))
+	tips[chain]["a"].LowerSince = time.Now().Add(-forkGrace)
+	unsafeTipGroups(chain)
+	if tip := tips[chain]["a"]; tip.Job.Index != 5 {
+		t.Fatalf("tip %d when another server agrees on the lower tip, want 5", tip.Job.Index)
+	}
+}
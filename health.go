@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// serverHealth what we have learned about a server so far
+type serverHealth struct {
+	Connects        uint64
+	ConnectFailures uint64
+	Jobs            uint64
+	FirstJobs       uint64
+	StaleJobs       uint64
+	// Disagreements tips that the other servers did not agree on
+	Disagreements uint64
+	// LagTotal how long after the first server the jobs of this server arrived
+	LagTotal time.Duration
+}
+
+// jobSighting the first time a job index was seen on a chain
+type jobSighting struct {
+	Index uint64
+	Time  time.Time
+}
+
+var healthMu sync.Mutex
+var healths map[string]*serverHealth
+var firstSeen map[uint64]jobSighting
+
+// serversInUse servers that a requestBlock of the chain is using
+var serversInUse map[uint64]map[string]bool
+
+func init() {
+	healths = make(map[string]*serverHealth)
+	firstSeen = make(map[uint64]jobSighting)
+	serversInUse = make(map[uint64]map[string]bool)
+}
+
+// unsafeHealth must be called with healthMu held
+func unsafeHealth(server string) *serverHealth {
+	h := healths[server]
+	if h == nil {
+		h = new(serverHealth)
+		healths[server] = h
+	}
+	return h
+}
+
+func recordConnect(server string, err error) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	h := unsafeHealth(server)
+	if err != nil {
+		h.ConnectFailures++
+	} else {
+		h.Connects++
+	}
+}
+
+// recordJob record when a job of the server arrived compared to the other servers
+func recordJob(chain uint64, server string, index uint64) {
+	now := time.Now()
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	h := unsafeHealth(server)
+	h.Jobs++
+	seen := firstSeen[chain]
+	switch {
+	case index > seen.Index:
+		firstSeen[chain] = jobSighting{index, now}
+		h.FirstJobs++
+	case index == seen.Index:
+		h.LagTotal += now.Sub(seen.Time)
+	default:
+		h.StaleJobs++
+	}
+}
+
+// recordDisagreement the server sent a tip that the other servers did not agree on
+func recordDisagreement(server string) {
+	healthMu.Lock()
+	unsafeHealth(server).Disagreements++
+	healthMu.Unlock()
+}
+
+func (h *serverHealth) avgLag() time.Duration {
+	if h.Jobs == h.StaleJobs {
+		return 0
+	}
+	return h.LagTotal / time.Duration(h.Jobs-h.StaleJobs)
+}
+
+// score 0~100, higher is better. Servers without history get the full score
+func (h *serverHealth) score(stat *submitStat) float64 {
+	out := 100.0
+	if tries := h.Connects + h.ConnectFailures; tries > 0 {
+		out -= 30 * float64(h.ConnectFailures) / float64(tries)
+	}
+	if h.Jobs > 0 {
+		out -= 20 * float64(h.StaleJobs) / float64(h.Jobs)
+		out -= 10 * (1 - float64(h.FirstJobs)/float64(h.Jobs))
+		out -= 30 * float64(h.Disagreements) / float64(h.Jobs)
+	}
+	lag := h.avgLag().Seconds()
+	if lag > 20 {
+		lag = 20
+	}
+	out -= lag
+	if stat != nil && stat.Submits > 0 {
+		out -= 20 * (1 - float64(stat.Accepted)/float64(stat.Submits))
+	}
+	if out < 0 {
+		out = 0
+	}
+	return out
+}
+
+func serverScore(server string) float64 {
+	healthMu.Lock()
+	h := *unsafeHealth(server)
+	healthMu.Unlock()
+	submitMu.Lock()
+	var stat *submitStat
+	if s := submitStats[server]; s != nil {
+		c := *s
+		stat = &c
+	}
+	submitMu.Unlock()
+	return h.score(stat)
+}
+
+// pickServer take the best scored server that the chain is not connected to yet, other than avoid
+func pickServer(chain uint64, avoid string) string {
+	var candidates []string
+	healthMu.Lock()
+	if serversInUse[chain] == nil {
+		serversInUse[chain] = make(map[string]bool)
+	}
+	for _, server := range conf.Servers {
+		if !serversInUse[chain][server] && server != avoid {
+			candidates = append(candidates, server)
+		}
+	}
+	healthMu.Unlock()
+	var usable []string
+	for _, server := range candidates {
+		if !breakerOpen(server) {
+			usable = append(usable, server)
+		}
+	}
+	candidates = usable
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	scores := make(map[string]float64)
+	for _, server := range candidates {
+		scores[server] = serverScore(server)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return scores[candidates[i]] > scores[candidates[j]]
+	})
+
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	for _, server := range candidates {
+		if !serversInUse[chain][server] {
+			serversInUse[chain][server] = true
+			return server
+		}
+	}
+	return ""
+}
+
+func releaseServer(chain uint64, server string) {
+	healthMu.Lock()
+	delete(serversInUse[chain], server)
+	healthMu.Unlock()
+}
+
+// betterServerIdle whether an unused server scores clearly better than the one in use
+func betterServerIdle(chain uint64, server string) bool {
+	var idle []string
+	healthMu.Lock()
+	for _, s := range conf.Servers {
+		if !serversInUse[chain][s] {
+			idle = append(idle, s)
+		}
+	}
+	healthMu.Unlock()
+	for i := 0; i < len(idle); i++ {
+		if breakerOpen(idle[i]) {
+			idle = append(idle[:i], idle[i+1:]...)
+			i--
+		}
+	}
+	current := serverScore(server)
+	for _, s := range idle {
+		if serverScore(s) > current+25 {
+			return true
+		}
+	}
+	return false
+}
+
+func showServerScores() {
+	servers := append([]string{}, conf.Servers...)
+	scores := make(map[string]float64)
+	for _, server := range servers {
+		scores[server] = serverScore(server)
+	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		return scores[servers[i]] > scores[servers[j]]
+	})
+	for _, server := range servers {
+		healthMu.Lock()
+		h := *unsafeHealth(server)
+		healthMu.Unlock()
+		submitMu.Lock()
+		var stat submitStat
+		if s := submitStats[server]; s != nil {
+			stat = *s
+		}
+		submitMu.Unlock()
+		clock := "unknown"
+		if off, ok := serverClockOffset(server); ok {
+			clock = off.Round(time.Millisecond).String()
+		}
+		fmt.Printf("server:%s, score:%.1f, connects:%d, connect failures:%d, jobs:%d, first:%d, stale:%d, disagreements:%d, lag:%dms, submits:%d, accepted:%d, clock offset:%s\n",
+			server, scores[server], h.Connects, h.ConnectFailures, h.Jobs, h.FirstJobs, h.StaleJobs, h.Disagreements,
+			h.avgLag().Milliseconds(), stat.Submits, stat.Accepted, clock)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+var errHalfOpen = errors.New("no response to keepalive, connection is half-open")
+
+// activityConn records when data was last read from the connection.
+// Pong frames are consumed inside the websocket package, so this is
+// the only place where they can be seen.
+type activityConn struct {
+	net.Conn
+	last int64
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *activityConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.last)))
+}
+
+// keepalive ping the server every keepalive_sec and close the websocket when
+// nothing, not even a pong, was read for keepalive_sec+keepalive_timeout_sec
+// or when a ping cannot be written. The read deadline is kept at the same
+// limit from the last ping, so a reader never blocks longer even if this goroutine is stuck.
+// It must be the only writer of ws once started. halfOpen is set before closing.
+func keepalive(ws *websocket.Conn, conn *activityConn, done chan struct{}, halfOpen *int32) {
+	interval := time.Duration(conf.KeepaliveSec) * time.Second
+	limit := interval + time.Duration(conf.KeepaliveTimeout)*time.Second
+	ws.PayloadType = websocket.PingFrame
+	ws.SetReadDeadline(time.Now().Add(limit))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if conn.idle() > limit {
+			atomic.StoreInt32(halfOpen, 1)
+			ws.Close()
+			return
+		}
+		ws.SetWriteDeadline(time.Now().Add(interval))
+		if _, err := ws.Write(nil); err != nil {
+			atomic.StoreInt32(halfOpen, 1)
+			ws.Close()
+			return
+		}
+		// a backstop only, the idle check above closes first while this runs
+		ws.SetReadDeadline(time.Now().Add(limit))
+	}
+}
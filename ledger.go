@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// payout methods of the reward-split reports
+const (
+	payoutPPLNS        = "pplns"
+	payoutProportional = "proportional"
+)
+
+// ledgerShare an accepted share. Its weight is the work expected to find it,
+// 2^HashPower, so shares of an easier level count for less.
+type ledgerShare struct {
+	Worker    string `json:"worker"`
+	Chain     uint64 `json:"chain"`
+	JobID     uint64 `json:"job"`
+	HashPower uint64 `json:"hp"`
+	Time      int64  `json:"time"`
+}
+
+func (s *ledgerShare) weight() float64 {
+	return math.Ldexp(1, int(s.HashPower))
+}
+
+// ledgerBlock a block found by a share of a worker
+type ledgerBlock struct {
+	Chain     uint64 `json:"chain"`
+	Key       string `json:"key"`
+	Worker    string `json:"worker"`
+	Time      int64  `json:"time"`
+	Confirmed bool   `json:"confirmed,omitempty"`
+	// the weights of the workers by the shares that found the block, by payout
+	// method. They are fixed when the block is found, the shares are dropped.
+	rounds map[string]map[string]float64
+}
+
+// ledgerEntry one line of the ledger file
+type ledgerEntry struct {
+	Share     *ledgerShare `json:"share,omitempty"`
+	Block     *ledgerBlock `json:"block,omitempty"`
+	Confirmed string       `json:"confirmed,omitempty"`
+}
+
+type payout struct {
+	Worker  string  `json:"worker"`
+	Weight  float64 `json:"weight"`
+	Blocks  float64 `json:"blocks"`
+	Percent float64 `json:"percent"`
+	Reward  float64 `json:"reward"`
+}
+
+type payoutReport struct {
+	Method  string   `json:"method"`
+	Window  int      `json:"window,omitempty"`
+	Blocks  int      `json:"blocks"`
+	Reward  float64  `json:"reward_per_block"`
+	Time    int64    `json:"time"`
+	Payouts []payout `json:"payouts"`
+}
+
+var ledgerMu sync.Mutex
+
+// ledgerShares the shares per chain that a block may still be split by: the
+// last PPLNSWindow ones and the ones since the last block of the chain
+var ledgerShares map[uint64][]ledgerShare
+
+// ledgerRoundStart the index in ledgerShares of the first share since the last block, per chain
+var ledgerRoundStart map[uint64]int
+var ledgerBlocks []*ledgerBlock
+var ledgerFile *os.File
+
+func init() {
+	ledgerShares = make(map[uint64][]ledgerShare)
+	ledgerRoundStart = make(map[uint64]int)
+}
+
+// openLedger load the ledger of conf.Pool.LedgerFile and append to it from now on
+func openLedger() error {
+	ledgerMu.Lock()
+	defer ledgerMu.Unlock()
+	f, err := os.OpenFile(conf.Pool.LedgerFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var e ledgerEntry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Printf("ledger %s:%d: %v\n", conf.Pool.LedgerFile, line, err)
+			continue
+		}
+		unsafeApplyLedger(e)
+	}
+	if err = scanner.Err(); err != nil {
+		f.Close()
+		return err
+	}
+	ledgerFile = f
+	return nil
+}
+
+// unsafeApplyLedger must be called with ledgerMu held
+func unsafeApplyLedger(e ledgerEntry) {
+	switch {
+	case e.Share != nil:
+		chain := e.Share.Chain
+		ledgerShares[chain] = append(ledgerShares[chain], *e.Share)
+		unsafeTrimShares(chain)
+	case e.Block != nil:
+		chain := e.Block.Chain
+		shares := ledgerShares[chain]
+		window := shares
+		if len(window) > conf.Pool.PPLNSWindow {
+			window = window[len(window)-conf.Pool.PPLNSWindow:]
+		}
+		e.Block.rounds = map[string]map[string]float64{
+			payoutPPLNS:        roundWeights(window),
+			payoutProportional: roundWeights(shares[ledgerRoundStart[chain]:]),
+		}
+		ledgerRoundStart[chain] = len(shares)
+		unsafeTrimShares(chain)
+		ledgerBlocks = append(ledgerBlocks, e.Block)
+	case e.Confirmed != "":
+		for _, b := range ledgerBlocks {
+			if b.Key == e.Confirmed {
+				b.Confirmed = true
+			}
+		}
+	}
+}
+
+// unsafeTrimShares must be called with ledgerMu held, drop the shares of the
+// chain that are neither in the PPLNS window nor in the current round
+func unsafeTrimShares(chain uint64) {
+	shares := ledgerShares[chain]
+	drop := len(shares) - conf.Pool.PPLNSWindow
+	if start := ledgerRoundStart[chain]; drop > start {
+		drop = start
+	}
+	if drop > 0 {
+		ledgerShares[chain] = shares[drop:]
+		ledgerRoundStart[chain] -= drop
+	}
+}
+
+// roundWeights the weight of every worker in the shares
+func roundWeights(shares []ledgerShare) map[string]float64 {
+	round := make(map[string]float64)
+	for i := range shares {
+		round[shares[i].Worker] += shares[i].weight()
+	}
+	return round
+}
+
+// unsafeWriteLedger must be called with ledgerMu held
+func unsafeWriteLedger(e ledgerEntry) {
+	unsafeApplyLedger(e)
+	if ledgerFile == nil {
+		return
+	}
+	data, _ := json.Marshal(e)
+	if _, err := ledgerFile.Write(append(data, '\n')); err != nil {
+		log.Println("fail to write the ledger:", err)
+	}
+}
+
+// ledgerAddShare record an accepted share of the worker
+func ledgerAddShare(worker string, chain, jobID, hp uint64) {
+	ledgerMu.Lock()
+	defer ledgerMu.Unlock()
+	unsafeWriteLedger(ledgerEntry{Share: &ledgerShare{
+		Worker:    worker,
+		Chain:     chain,
+		JobID:     jobID,
+		HashPower: hp,
+		Time:      time.Now().Unix(),
+	}})
+}
+
+// ledgerAddBlock record a block found by the worker
+func ledgerAddBlock(worker string, chain uint64, key []byte) {
+	ledgerMu.Lock()
+	defer ledgerMu.Unlock()
+	unsafeWriteLedger(ledgerEntry{Block: &ledgerBlock{
+		Chain:  chain,
+		Key:    hex.EncodeToString(key),
+		Worker: worker,
+		Time:   time.Now().Unix(),
+	}})
+}
+
+// ledgerConfirm mark the block as confirmed if a worker of the pool found it
+func ledgerConfirm(key []byte) {
+	k := hex.EncodeToString(key)
+	ledgerMu.Lock()
+	defer ledgerMu.Unlock()
+	for _, b := range ledgerBlocks {
+		if b.Key == k && !b.Confirmed {
+			unsafeWriteLedger(ledgerEntry{Confirmed: k})
+			return
+		}
+	}
+}
+
+// payoutSplit split the confirmed blocks between the workers, every block
+// is split by the weight of the shares that found it: the shares of its
+// chain since the previous block (proportional) or the last PPLNSWindow
+// shares of its chain (pplns).
+func payoutSplit(method string, reward float64) (*payoutReport, error) {
+	if method != payoutPPLNS && method != payoutProportional {
+		return nil, fmt.Errorf("unknown payout method: %s", method)
+	}
+	rpt := &payoutReport{Method: method, Reward: reward, Time: time.Now().Unix()}
+	if method == payoutPPLNS {
+		rpt.Window = conf.Pool.PPLNSWindow
+	}
+	weights := make(map[string]float64)
+	credits := make(map[string]float64)
+
+	ledgerMu.Lock()
+	for _, b := range ledgerBlocks {
+		if !b.Confirmed {
+			continue
+		}
+		round := b.rounds[method]
+		var total float64
+		for _, v := range round {
+			total += v
+		}
+		if total == 0 {
+			// no share to split by, the finder takes it all
+			round = map[string]float64{b.Worker: 1}
+			total = 1
+		}
+		rpt.Blocks++
+		for w, v := range round {
+			weights[w] += v
+			credits[w] += v / total
+		}
+	}
+	ledgerMu.Unlock()
+
+	for w, credit := range credits {
+		p := payout{Worker: w, Weight: weights[w], Blocks: credit, Reward: credit * reward}
+		p.Percent = credit / float64(rpt.Blocks) * 100
+		rpt.Payouts = append(rpt.Payouts, p)
+	}
+	sort.Slice(rpt.Payouts, func(i, j int) bool {
+		return rpt.Payouts[i].Worker < rpt.Payouts[j].Worker
+	})
+	return rpt, nil
+}
+
+func (rpt *payoutReport) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rpt)
+}
+
+func (rpt *payoutReport) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"worker", "weight", "blocks", "percent", "reward"})
+	for _, p := range rpt.Payouts {
+		cw.Write([]string{
+			p.Worker,
+			strconv.FormatFloat(p.Weight, 'f', 0, 64),
+			strconv.FormatFloat(p.Blocks, 'f', 6, 64),
+			strconv.FormatFloat(p.Percent, 'f', 3, 64),
+			strconv.FormatFloat(p.Reward, 'f', 9, 64),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportPayouts ask for the method and format of a payout report and write it
+func exportPayouts() {
+	if conf.Pool.Listen == "" {
+		fmt.Println("pool is not enabled")
+		return
+	}
+	var method, format, file string
+	var reward float64
+	fmt.Printf("payout method (%s/%s):", payoutPPLNS, payoutProportional)
+	fmt.Scanln(&method)
+	fmt.Print("format (csv/json):")
+	fmt.Scanln(&format)
+	fmt.Print("reward of a block in govm, 0 if unknown:")
+	fmt.Scanln(&reward)
+	fmt.Print("file name, empty to print:")
+	fmt.Scanln(&file)
+
+	rpt, err := payoutSplit(method, reward)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	var out io.Writer = os.Stdout
+	if file != "" {
+		f, err := os.Create(file)
+		if err != nil {
+			fmt.Println("fail to create the report:", err)
+			return
+		}
+		defer f.Close()
+		out = f
+	}
+	switch format {
+	case "csv":
+		err = rpt.writeCSV(out)
+	case "json":
+		err = rpt.writeJSON(out)
+	default:
+		err = fmt.Errorf("unknown format: %s", format)
+	}
+	if err != nil {
+		fmt.Println("fail to write the report:", err)
+		return
+	}
+	if file != "" {
+		fmt.Printf("%s report of %d confirmed blocks written to %s\n", rpt.Method, rpt.Blocks, file)
+	}
+}
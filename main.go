@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
@@ -10,7 +11,6 @@ import (
 	"os"
 	"runtime/pprof"
 	"strconv"
-	"time"
 
 	"github.com/lengzhao/govm/wallet"
 )
@@ -25,7 +25,37 @@ type Config struct {
 	Sleep             uint64   `json:"chunk_sleep_msec,omitempty"`
 	Chains            []uint64 `json:"chains,omitempty"`
 	KeepConnServerNum int      `json:"keep_conn_server_num,omitempty"`
-	Verbosity         uint     `json:"verbosity,omitempty"`
+	SubmitStrategy    string   `json:"submit_strategy,omitempty"`
+	SubmitServerNum   int      `json:"submit_server_num,omitempty"`
+	ReconnectMinSec   uint     `json:"reconnect_min_sec,omitempty"`
+	ReconnectMaxSec   uint     `json:"reconnect_max_sec,omitempty"`
+	BreakerFailures   int      `json:"breaker_failures,omitempty"`
+	BreakerCooldown   uint     `json:"breaker_cooldown_sec,omitempty"`
+	KeepaliveSec      uint     `json:"keepalive_sec,omitempty"`
+	KeepaliveTimeout  uint     `json:"keepalive_timeout_sec,omitempty"`
+	RequestTimeoutSec uint     `json:"request_timeout_sec,omitempty"`
+	// ConsensusServers mine a job once that many servers agree on it, 0 or 1 to mine any job
+	ConsensusServers    int  `json:"consensus_servers,omitempty"`
+	ConsensusTimeoutSec uint `json:"consensus_timeout_sec,omitempty"`
+	// AutoChains mine the chains of the node that the wallet is a miner of, instead of Chains
+	AutoChains   bool `json:"auto_chains,omitempty"`
+	ChainScanSec uint `json:"chain_scan_sec,omitempty"`
+	// ClockSkewWarnSec warn when the clock of a server is off by more
+	ClockSkewWarnSec uint `json:"clock_skew_warn_sec,omitempty"`
+	// MaxJobAgeSec refuse jobs older than that by the clock of the servers, 0 to take any
+	MaxJobAgeSec uint `json:"max_job_age_sec,omitempty"`
+	// RegistrationCheckSec check that the wallet is still a miner this often
+	RegistrationCheckSec uint `json:"registration_check_sec,omitempty"`
+	Verbosity            uint `json:"verbosity,omitempty"`
+
+	TLS         TLSConfig         `json:"tls,omitempty"`
+	Proxy       string            `json:"proxy,omitempty"`
+	ServerProxy map[string]string `json:"server_proxy,omitempty"`
+	Pool        PoolConfig        `json:"pool,omitempty"`
+	Worker      WorkerConfig      `json:"worker,omitempty"`
+	// FanoutListen serve the jobs of this process to miners on the LAN
+	FanoutListen string      `json:"fanout_listen,omitempty"`
+	Sweep        SweepConfig `json:"sweep,omitempty"`
 }
 
 const version = "v0.5.3"
@@ -53,10 +83,108 @@ func loadConfig(fileName string) {
 		log.Println("fail to Unmarshal configure.", err)
 		os.Exit(2)
 	}
-	if len(conf.Servers) == 0 {
+	if len(conf.Servers) == 0 && conf.Worker.Coordinator == "" {
 		log.Println("server list is empty")
 		os.Exit(2)
 	}
+	if conf.Worker.Coordinator != "" {
+		u, err := serverURL(conf.Worker.Coordinator)
+		if err != nil {
+			log.Println("invalid coordinator:", conf.Worker.Coordinator, err)
+			os.Exit(2)
+		}
+		if u.Scheme != "https" && !conf.Worker.Insecure {
+			log.Println("the coordinator does not use TLS, the signing key would come in plaintext. Use wss:// or set worker.insecure:", conf.Worker.Coordinator)
+			os.Exit(2)
+		}
+	}
+	for _, server := range conf.Servers {
+		if _, err = serverURL(server); err != nil {
+			log.Println("invalid server:", server, err)
+			os.Exit(2)
+		}
+	}
+	if err = setupTransport(); err != nil {
+		log.Println("fail to load TLS or proxy configure.", err)
+		os.Exit(2)
+	}
+	if conf.ReconnectMinSec == 0 {
+		conf.ReconnectMinSec = 1
+	}
+	if conf.ReconnectMaxSec == 0 {
+		conf.ReconnectMaxSec = 60
+	}
+	if conf.ReconnectMaxSec < conf.ReconnectMinSec {
+		conf.ReconnectMaxSec = conf.ReconnectMinSec
+	}
+	if conf.BreakerFailures <= 0 {
+		conf.BreakerFailures = 5
+	}
+	if conf.BreakerCooldown == 0 {
+		conf.BreakerCooldown = 300
+	}
+	if conf.KeepaliveSec == 0 {
+		conf.KeepaliveSec = 5
+	}
+	if conf.KeepaliveTimeout == 0 {
+		conf.KeepaliveTimeout = 5
+	}
+	if conf.RequestTimeoutSec == 0 {
+		conf.RequestTimeoutSec = 10
+	}
+	if conf.ClockSkewWarnSec == 0 {
+		conf.ClockSkewWarnSec = 10
+	}
+	if conf.RegistrationCheckSec == 0 {
+		conf.RegistrationCheckSec = 300
+	}
+	if conf.ChainScanSec == 0 {
+		conf.ChainScanSec = 600
+	}
+	if conf.ConsensusTimeoutSec == 0 {
+		conf.ConsensusTimeoutSec = 30
+	}
+	// votes only come from the connected servers of a chain
+	if conf.ConsensusServers > 1 {
+		most := conf.KeepConnServerNum
+		if len(conf.Servers) < most {
+			most = len(conf.Servers)
+		}
+		if conf.ConsensusServers > most {
+			log.Printf("WARNING, consensus_servers %d is more than the %d servers a chain connects to, using %d\n",
+				conf.ConsensusServers, most, most)
+			conf.ConsensusServers = most
+		}
+	}
+	if conf.Pool.NonceRange == 0 {
+		conf.Pool.NonceRange = 1 << 20
+	}
+	if conf.Pool.LedgerFile == "" {
+		conf.Pool.LedgerFile = "pool.ledger"
+	}
+	if conf.Pool.PPLNSWindow <= 0 {
+		conf.Pool.PPLNSWindow = 10000
+	}
+	if conf.Sweep.ColdAddress != "" {
+		if conf.Sweep.IntervalSec == 0 {
+			conf.Sweep.IntervalSec = 600
+		}
+		if conf.Sweep.LogFile == "" {
+			conf.Sweep.LogFile = "sweep.log"
+		}
+		if err = checkSweepConfig(); err != nil {
+			log.Println("invalid sweep configure.", err)
+			os.Exit(2)
+		}
+	}
+	switch conf.SubmitStrategy {
+	case "":
+		conf.SubmitStrategy = submitOrigin
+	case submitOrigin, submitAll, submitFirstN:
+	default:
+		log.Println("unknown submit strategy:", conf.SubmitStrategy)
+		os.Exit(2)
+	}
 }
 
 // loadWallet load wallet
@@ -113,8 +241,29 @@ func main() {
 	log.SetFlags(log.Lshortfile | log.LstdFlags)
 	fmt.Println("version of govm mining:", version)
 
+	if !flag.Parsed() {
+		flag.Parse()
+	}
+	// the offline host signs without conf.json
+	if flag.Arg(0) == "tx-sign" {
+		os.Exit(cmdTxSign(flag.Args()[1:]))
+	}
+
 	loadConfig("./conf.json")
 
+	// commands that do not use the wallet of conf.json
+	switch flag.Arg(0) {
+	case "worker":
+		if conf.Worker.Coordinator == "" {
+			log.Fatalln("worker.coordinator is empty")
+		}
+		runWorker()
+	case "tx-build":
+		os.Exit(cmdTxBuild(flag.Args()[1:]))
+	case "tx-broadcast":
+		os.Exit(cmdTxBroadcast(flag.Args()[1:]))
+	}
+
 	if !InternalUseOnly {
 		loadWallet("wallet.dev.key", "ERROR, %s is not a miner on chain %d\n\x00", true)
 		devKey = wal.Key
@@ -133,18 +282,21 @@ func main() {
 	devAddrStr = hex.EncodeToString(devAddress)
 	userAddrStr = hex.EncodeToString(userAddress)
 
-	for _, chain := range conf.Chains {
-		if !isMiner(chain, conf.Servers[0], devAddrStr) {
-			log.Fatalf("ERROR, %s (DEV) is not a miner on chain %d\n", devAddrStr, chain)
-			os.Exit(-1)
-		}
-		time.Sleep(1 * time.Second)
-		if !isMiner(chain, conf.Servers[0], userAddrStr) {
-			log.Fatalf("ERROR, %s is not a miner on chain %d\n", userAddrStr, chain)
-			os.Exit(-1)
-		}
-		time.Sleep(1 * time.Second)
+	switch flag.Arg(0) {
+	case "register-miner":
+		os.Exit(cmdRegisterMiner(flag.Args()[1:]))
+	case "transfer":
+		os.Exit(cmdTransfer(flag.Args()[1:]))
+	case "query":
+		os.Exit(cmdQuery(flag.Args()[1:]))
+	}
+
+	if conf.AutoChains {
+		// found and checked by updateChains
+		conf.Chains = nil
 	}
+	// a chain that the wallet is not a miner of is paused, not fatal
+	checkRegistrations()
 
 	fmt.Println("                                                                                   ''''''")
 	fmt.Println(" BBBBBBBBBBBBBBBBB     iiii                                OOOOOOOOO     lllllll  '::::'        ⣧     ⣿")
@@ -196,6 +348,30 @@ func main() {
 
 	updateBlock()
 	doMining()
+	if conf.AutoChains {
+		if err := updateChains(); err != nil {
+			log.Fatalln("fail to discover chains:", err)
+		}
+		fmt.Printf("mining chains %v, looking for others every %ds\n", activeChains(), conf.ChainScanSec)
+		go watchChains()
+	}
+	go watchRegistrations()
+	go trackConfirms()
+	if conf.Pool.Listen != "" {
+		if err := startPool(); err != nil {
+			log.Fatalln("fail to start pool:", err)
+		}
+	}
+	if conf.FanoutListen != "" {
+		if err := startFanout(); err != nil {
+			log.Fatalln("fail to start fanout:", err)
+		}
+	}
+	if conf.Sweep.ColdAddress != "" {
+		if err := startSweeper(); err != nil {
+			log.Fatalln("fail to start sweeper:", err)
+		}
+	}
 
 	var cmd string
 	var descList = []string{
@@ -208,6 +384,13 @@ func main() {
 		"show balance",
 		"is miner",
 		"quit",
+		"show submissions",
+		"show server scores",
+		"show connections",
+		"show pool workers",
+		"export pool payouts",
+		"transfer",
+		"query data",
 	}
 	for {
 		ops, _ := strconv.ParseInt(cmd, 10, 32)
@@ -231,29 +414,52 @@ func main() {
 		case 5:
 			fmt.Println("DISABLED")
 		case 6:
-			for _, c := range conf.Chains {
-				val := getDataFromServer(c, conf.Servers[0], "", "dbCoin", userAddrStr)
-				var coins uint64
-				if len(val) > 0 {
-					Decode(val, &coins)
+			for _, c := range activeChains() {
+				coins, err := getCoins(context.Background(), NewNodeClient(conf.Servers[0]), c, userAddrStr)
+				if err != nil {
+					fmt.Printf("chain:%d, fail to get balance: %v\n", c, err)
+					continue
 				}
-				fmt.Printf("chain:%d, balance:%.3f govm\n", c, float64(coins)/1000000000)
+				fmt.Printf("chain:%d, balance:%.3f govm\n", c, toGovm(coins))
 			}
 		case 7:
-			for _, c := range conf.Chains {
-				if isMiner(c, conf.Servers[0], userAddrStr) {
-					fmt.Printf("chain:%d, is a miner\n", c)
-				} else {
-					fmt.Printf("waring. chain:%d, not a miner\n", c)
+			checkRegistrations()
+			for _, c := range activeChains() {
+				if reason := chainPaused(c); reason != "" {
+					fmt.Printf("waring. chain:%d, paused: %s\n", c, reason)
+					continue
+				}
+				m, err := getMinerRecord(context.Background(), NewNodeClient(conf.Servers[0]), c, userAddrStr)
+				switch {
+				case err == ErrNotFound:
+					fmt.Printf("chain:%d, not a miner\n", c)
+				case err != nil:
+					fmt.Printf("chain:%d, fail to get the registration: %v\n", c, err)
+				default:
+					fmt.Printf("chain:%d, is a miner, %s\n", c, m)
 				}
 			}
 		case 8:
 			fmt.Println("exiting")
-			time.Sleep(time.Second)
+			stopAllSupervisors()
 			if InternalUseOnly {
 				pprof.StopCPUProfile()
 			}
 			os.Exit(0)
+		case 9:
+			showSubmissions()
+		case 10:
+			showServerScores()
+		case 11:
+			showConnections()
+		case 12:
+			showPoolWorkers()
+		case 13:
+			exportPayouts()
+		case 14:
+			menuTransfer()
+		case 15:
+			menuQuery()
 		default:
 			fmt.Println("Please enter the operation number")
 			for i, it := range descList {
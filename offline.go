@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/howeyc/gopass"
+	"github.com/lengzhao/govm/wallet"
+)
+
+// acceptTransTime how long the node takes a transaction after its time, like core
+const acceptTransTime = 10 * 24 * time.Hour
+
+// txFile a transaction carried between the online host, which builds and
+// broadcasts it, and the offline host, which holds the wallet and signs it
+type txFile struct {
+	Note   string `json:"note"`
+	Chain  uint64 `json:"chain"`
+	Time   uint64 `json:"time"`
+	User   string `json:"user"`
+	Energy uint64 `json:"energy"`
+	Cost   uint64 `json:"cost"`
+	Ops    uint8  `json:"ops"`
+	Data   string `json:"data"`
+	Sign   string `json:"sign,omitempty"`
+	Key    string `json:"key,omitempty"`
+}
+
+// describeTransaction what the transaction does, for a human to check before signing
+func describeTransaction(t *Transaction) string {
+	switch t.Ops {
+	case OpsTransfer:
+		return fmt.Sprintf("transfer %.3f govm from %x to %x on chain %d", toGovm(t.Cost), t.User, t.Data, t.Chain)
+	case OpsRegisterMiner:
+		var info RegMiner
+		Decode(t.Data, &info)
+		return fmt.Sprintf("register %x as a miner of index %d on chain %d, cost %.3f govm", t.User, info.Index, t.Chain, toGovm(t.Cost))
+	default:
+		return fmt.Sprintf("ops %d of %x on chain %d, cost %.3f govm", t.Ops, t.User, t.Chain, toGovm(t.Cost))
+	}
+}
+
+func newTxFile(t *Transaction) *txFile {
+	f := &txFile{
+		Note:   describeTransaction(t),
+		Chain:  t.Chain,
+		Time:   t.Time,
+		User:   hex.EncodeToString(t.User[:]),
+		Energy: t.Energy,
+		Cost:   t.Cost,
+		Ops:    t.Ops,
+		Data:   hex.EncodeToString(t.Data),
+	}
+	if len(t.Sign) > 0 {
+		_, key := t.Output()
+		f.Sign = hex.EncodeToString(t.Sign)
+		f.Key = hex.EncodeToString(key)
+	}
+	return f
+}
+
+// transaction the transaction of the file, the note is not trusted and rebuilt from it
+func (f *txFile) transaction() (*Transaction, error) {
+	t := new(Transaction)
+	t.Chain = f.Chain
+	t.Time = f.Time
+	t.Energy = f.Energy
+	t.Cost = f.Cost
+	t.Ops = f.Ops
+	user, err := parseAddress(f.User)
+	if err != nil {
+		return nil, err
+	}
+	t.User = user
+	if t.Data, err = hex.DecodeString(f.Data); err != nil {
+		return nil, fmt.Errorf("invalid data: %v", err)
+	}
+	if t.Sign, err = hex.DecodeString(f.Sign); err != nil {
+		return nil, fmt.Errorf("invalid sign: %v", err)
+	}
+	return t, nil
+}
+
+func readTxFile(fileName string) (*Transaction, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	f := new(txFile)
+	if err = json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("invalid transaction file %s: %v", fileName, err)
+	}
+	return f.transaction()
+}
+
+func writeTxFile(fileName string, t *Transaction) error {
+	data, _ := json.MarshalIndent(newTxFile(t), "", "  ")
+	return ioutil.WriteFile(fileName, append(data, '\n'), 0600)
+}
+
+// cmdTxBuild build an unsigned transaction of a wallet that is not on this host,
+// return the exit code
+func cmdTxBuild(args []string) int {
+	fs := flag.NewFlagSet("tx-build", flag.ExitOnError)
+	kind := fs.String("type", "transfer", "transfer or register-miner")
+	from := fs.String("from", "", "address (hex) of the wallet that signs it")
+	chain := fs.Uint64("chain", 0, "chain of the transaction, default the first of chains")
+	to := fs.String("to", "", "transfer: address (hex) of the payee")
+	amount := fs.Float64("amount", 0, "transfer: govm to transfer")
+	index := fs.Uint64("index", 0, "register-miner: index of the block to mine from, default 50 blocks after the last one")
+	cost := fs.Float64("cost", 0, "register-miner: govm to pay, default 3 times of the guerdon")
+	out := fs.String("out", "tx.json", "file of the unsigned transaction")
+	fs.Parse(args)
+	if *chain == 0 {
+		*chain = defaultChain()
+	}
+	user, err := parseAddress(*from)
+	if err != nil {
+		fmt.Println("-from:", err)
+		return 1
+	}
+
+	var trans *Transaction
+	switch *kind {
+	case "transfer":
+		var payee Address
+		if payee, err = parseAddress(*to); err != nil {
+			fmt.Println("-to:", err)
+			return 1
+		}
+		trans, err = buildTransfer(*chain, user[:], payee, fromGovm(*amount))
+	case "register-miner":
+		trans, err = buildRegisterMiner(*chain, user[:], *index, fromGovm(*cost))
+	default:
+		err = fmt.Errorf("unknown type: %s", *kind)
+	}
+	if err != nil {
+		fmt.Printf("chain:%d, %v\n", *chain, err)
+		return 1
+	}
+	if err = writeTxFile(*out, trans); err != nil {
+		fmt.Println("fail to write the transaction:", err)
+		return 1
+	}
+	fmt.Printf("%s\nunsigned transaction written to %s, sign it on the offline host within %s\n",
+		describeTransaction(trans), *out, acceptTransTime)
+	return 0
+}
+
+// cmdTxSign sign a transaction file with a wallet file, needs neither the
+// network nor conf.json. Return the exit code.
+func cmdTxSign(args []string) int {
+	fs := flag.NewFlagSet("tx-sign", flag.ExitOnError)
+	in := fs.String("in", "tx.json", "file of the unsigned transaction")
+	out := fs.String("out", "tx.signed.json", "file of the signed transaction")
+	walletFile := fs.String("wallet", "wallet.key", "wallet file, as written by wallet.SaveWallet")
+	password := fs.String("password", "", "password of the wallet, asked if empty")
+	yes := fs.Bool("yes", false, "sign without asking")
+	fs.Parse(args)
+
+	trans, err := readTxFile(*in)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if *password == "" {
+		fmt.Print("password of the wallet:")
+		pwd, err := gopass.GetPasswdMasked()
+		if err != nil {
+			fmt.Println("fail to read the password:", err)
+			return 1
+		}
+		*password = string(pwd)
+	}
+	w, err := wallet.LoadWallet(*walletFile, *password)
+	if err != nil {
+		fmt.Printf("fail to load wallet %s: %v\n", *walletFile, err)
+		return 1
+	}
+	if !bytes.Equal(w.Address, trans.User[:]) {
+		fmt.Printf("the transaction is of %x, not of the wallet %x\n", trans.User, w.Address)
+		return 1
+	}
+	fmt.Println(describeTransaction(trans))
+	if !*yes {
+		var confirm string
+		fmt.Print("sign it? (y/n):")
+		fmt.Scanln(&confirm)
+		if confirm != "y" {
+			fmt.Println("canceled")
+			return 1
+		}
+	}
+	if err = trans.SetSign(w.Key, w.SignPrefix); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if err = writeTxFile(*out, trans); err != nil {
+		fmt.Println("fail to write the transaction:", err)
+		return 1
+	}
+	fmt.Printf("signed transaction written to %s, broadcast it on the online host\n", *out)
+	return 0
+}
+
+// checkSigned check the signature and the age of the transaction before it is broadcast
+func checkSigned(t *Transaction) error {
+	if len(t.Sign) == 0 {
+		return errors.New("the transaction is not signed")
+	}
+	if !wallet.Recover(t.User[:], t.Sign, t.SignData()) {
+		return errors.New("the signature does not match the transaction")
+	}
+	age := time.Since(time.Unix(0, int64(t.Time)*int64(time.Millisecond)))
+	if age > acceptTransTime {
+		return fmt.Errorf("the transaction is %s old, the node takes it for %s, build it again", age.Round(time.Hour), acceptTransTime)
+	}
+	return nil
+}
+
+// cmdTxBroadcast send a signed transaction file and wait for its confirmation,
+// return the exit code
+func cmdTxBroadcast(args []string) int {
+	fs := flag.NewFlagSet("tx-broadcast", flag.ExitOnError)
+	in := fs.String("in", "tx.signed.json", "file of the signed transaction")
+	wait := fs.Duration("wait", 30*time.Minute, "how long to wait for the confirmation, 0 to not wait")
+	fs.Parse(args)
+
+	trans, err := readTxFile(*in)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if err = checkSigned(trans); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	data, key := trans.Output()
+	if err = broadcastTransaction(trans.Chain, data); err != nil {
+		fmt.Printf("chain:%d, fail to send the transaction: %v\n", trans.Chain, err)
+		return 1
+	}
+	fmt.Printf("chain:%d, %s, sent, transaction:%x\n", trans.Chain, describeTransaction(trans), key)
+	if *wait == 0 {
+		return 0
+	}
+	index, err := waitTransaction(trans.Chain, key, *wait)
+	if err != nil {
+		fmt.Printf("chain:%d, transaction:%x %v\n", trans.Chain, key, err)
+		return 1
+	}
+	fmt.Printf("chain:%d, transaction:%x confirmed in block %d\n", trans.Chain, key, index)
+	return 0
+}
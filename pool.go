@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lengzhao/govm/wallet"
+	"golang.org/x/net/websocket"
+)
+
+// PoolConfig the coordinator side of a mining pool
+type PoolConfig struct {
+	Listen         string   `json:"listen,omitempty"`
+	CertFile       string   `json:"cert_file,omitempty"`
+	KeyFile        string   `json:"key_file,omitempty"`
+	Workers        []string `json:"workers,omitempty"`
+	ShareHashPower uint64   `json:"share_hash_power,omitempty"`
+	NonceRange     uint64   `json:"nonce_range,omitempty"`
+	LedgerFile     string   `json:"ledger_file,omitempty"`
+	PPLNSWindow    int      `json:"pplns_window,omitempty"`
+	// Insecure serve workers without cert_file, the signing key goes in plaintext
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+const poolPath = "/pool/ws"
+
+// messages between coordinator and workers
+const (
+	poolMsgJob      = "job"
+	poolMsgShare    = "share"
+	poolMsgResult   = "result"
+	poolMsgRange    = "range"
+	poolMsgHashrate = "hashrate"
+	poolMsgError    = "error"
+)
+
+// poolHead the handshake of a worker, followed by its signature, like wsHead
+type poolHead struct {
+	Addr Address
+	Time int64
+}
+
+// poolJob work for a worker: a nonce range of a block. Key is the signing key of
+// the producer: govm signs the block inside the proof of work, so no nonce can be
+// tried without it. It only goes over TLS unless pool.insecure is set, and workers
+// must only keep it in memory.
+type poolJob struct {
+	ID             uint64
+	Block          Block
+	HashpowerLimit uint64
+	ShareHashPower uint64
+	NonceStart     uint64
+	NonceCount     uint64
+	Key            []byte
+}
+
+// poolShare a solution of a worker: the nonce and the range it was assigned in.
+// The coordinator signs the block with the nonce itself, nothing signed by the
+// worker is posted.
+type poolShare struct {
+	JobID      uint64
+	Nonce      uint64
+	RangeStart uint64
+	RangeCount uint64
+}
+
+type poolResult struct {
+	JobID    uint64
+	Nonce    uint64
+	Accepted bool
+	Block    bool
+	Reason   string
+}
+
+type poolMessage struct {
+	Type     string      `json:"type"`
+	Job      *poolJob    `json:"job,omitempty"`
+	Share    *poolShare  `json:"share,omitempty"`
+	Result   *poolResult `json:"result,omitempty"`
+	Hashrate uint64      `json:"hashrate,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// poolJobState a job of the coordinator, shared by all workers of its chain
+type poolJobState struct {
+	ID         uint64
+	Chain      uint64
+	Block      *RespBlockWithKey
+	ShareLimit uint64
+	next       uint64
+	seen       map[uint64]bool
+}
+
+type poolSession struct {
+	worker string
+	ws     *websocket.Conn
+	sendMu sync.Mutex
+	chain  uint64
+	// ranges the nonce ranges given to this session, by job
+	ranges map[uint64][][2]uint64
+}
+
+type workerStat struct {
+	Shares    uint64
+	Rejected  uint64
+	Blocks    uint64
+	Hashrate  uint64
+	LastSeen  time.Time
+	Connected int
+}
+
+var poolMu sync.Mutex
+var poolNextID uint64
+var poolJobs map[uint64]*poolJobState
+var poolCurrent map[uint64]*poolJobState
+var poolSessions map[*poolSession]bool
+var workerStats map[string]*workerStat
+
+func init() {
+	poolJobs = make(map[uint64]*poolJobState)
+	poolCurrent = make(map[uint64]*poolJobState)
+	poolSessions = make(map[*poolSession]bool)
+	workerStats = make(map[string]*workerStat)
+}
+
+func (s *poolSession) send(msg poolMessage) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	s.ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return websocket.JSON.Send(s.ws, msg)
+}
+
+// startPool serve workers on conf.Pool.Listen
+func startPool() error {
+	if len(conf.Pool.Workers) == 0 {
+		return errors.New("pool.workers is empty, no worker could join")
+	}
+	if conf.Pool.CertFile == "" {
+		if !conf.Pool.Insecure {
+			return errors.New("pool.cert_file is empty, workers would get the signing key in plaintext. Set pool.insecure to allow it")
+		}
+		log.Println("WARNING, the pool does not use TLS, signing keys are sent in plaintext")
+	}
+	if err := openLedger(); err != nil {
+		return fmt.Errorf("fail to open the ledger: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(poolPath, websocket.Server{Handler: servePoolWorker})
+	srv := &http.Server{Addr: conf.Pool.Listen, Handler: mux}
+	go func() {
+		var err error
+		if conf.Pool.CertFile != "" {
+			err = srv.ListenAndServeTLS(conf.Pool.CertFile, conf.Pool.KeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		log.Fatalln("pool server stopped:", err)
+	}()
+	go refreshPoolJobs()
+	fmt.Println("pool listening on", conf.Pool.Listen)
+	return nil
+}
+
+// checkPoolHead verify the signed handshake of a worker, return its address
+func checkPoolHead(data []byte) (string, error) {
+	headLen := binary.Size(poolHead{})
+	if len(data) <= headLen {
+		return "", errors.New("short handshake")
+	}
+	head := poolHead{}
+	if Decode(data[:headLen], &head) == 0 {
+		return "", errors.New("invalid handshake")
+	}
+	if !wallet.Recover(head.Addr[:], data[headLen:], data[:headLen]) {
+		return "", errors.New("bad signature")
+	}
+	if d := time.Since(time.Unix(head.Time, 0)); d > 5*time.Minute || d < -5*time.Minute {
+		return "", fmt.Errorf("handshake time is off by %s", d)
+	}
+	addr := hex.EncodeToString(head.Addr[:])
+	for _, w := range conf.Pool.Workers {
+		if w == addr {
+			return addr, nil
+		}
+	}
+	return "", fmt.Errorf("worker %s is not allowed", addr)
+}
+
+func servePoolWorker(ws *websocket.Conn) {
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 256)
+	n, err := ws.Read(buf)
+	if err != nil {
+		return
+	}
+	worker, err := checkPoolHead(buf[:n])
+	if err != nil {
+		log.Println("pool: refused worker,", ws.Request().RemoteAddr, err)
+		websocket.JSON.Send(ws, poolMessage{Type: poolMsgError, Error: err.Error()})
+		return
+	}
+	ws.SetReadDeadline(time.Time{})
+
+	s := &poolSession{worker: worker, ws: ws, ranges: make(map[uint64][][2]uint64)}
+	poolMu.Lock()
+	s.chain = leastLoadedChain()
+	poolSessions[s] = true
+	stat := unsafeWorkerStat(worker)
+	stat.Connected++
+	stat.LastSeen = time.Now()
+	job := poolCurrent[s.chain]
+	poolMu.Unlock()
+	log.Printf("pool: worker %s joined, chain:%d\n", worker, s.chain)
+	defer func() {
+		poolMu.Lock()
+		delete(poolSessions, s)
+		unsafeWorkerStat(worker).Connected--
+		poolMu.Unlock()
+		log.Printf("pool: worker %s left\n", worker)
+	}()
+	if job != nil {
+		s.assign(job)
+	}
+
+	for {
+		var msg poolMessage
+		if err = websocket.JSON.Receive(ws, &msg); err != nil {
+			return
+		}
+		poolMu.Lock()
+		unsafeWorkerStat(worker).LastSeen = time.Now()
+		poolMu.Unlock()
+		switch msg.Type {
+		case poolMsgShare:
+			if msg.Share == nil {
+				continue
+			}
+			rst := s.checkShare(*msg.Share)
+			s.send(poolMessage{Type: poolMsgResult, Result: &rst})
+		case poolMsgRange:
+			poolMu.Lock()
+			job := poolCurrent[s.chain]
+			poolMu.Unlock()
+			if job != nil {
+				s.assign(job)
+			}
+		case poolMsgHashrate:
+			poolMu.Lock()
+			unsafeWorkerStat(worker).Hashrate = msg.Hashrate
+			poolMu.Unlock()
+		}
+	}
+}
+
+// unsafeWorkerStat must be called with poolMu held
+func unsafeWorkerStat(worker string) *workerStat {
+	stat := workerStats[worker]
+	if stat == nil {
+		stat = new(workerStat)
+		workerStats[worker] = stat
+	}
+	return stat
+}
+
+// leastLoadedChain must be called with poolMu held
+func leastLoadedChain() uint64 {
+	load := make(map[uint64]int)
+	for s := range poolSessions {
+		load[s.chain]++
+	}
+	chains := activeChains()
+	if len(chains) == 0 {
+		return defaultChain()
+	}
+	best := chains[0]
+	for _, c := range chains {
+		if load[c] < load[best] {
+			best = c
+		}
+	}
+	return best
+}
+
+// assign give the session the next nonce range of the job
+func (s *poolSession) assign(job *poolJobState) error {
+	poolMu.Lock()
+	start := job.next
+	job.next += conf.Pool.NonceRange
+	s.ranges[job.ID] = append(s.ranges[job.ID], [2]uint64{start, start + conf.Pool.NonceRange})
+	msg := poolJob{
+		ID:             job.ID,
+		Block:          job.Block.Block,
+		HashpowerLimit: job.Block.HashpowerLimit,
+		ShareHashPower: job.ShareLimit,
+		NonceStart:     start,
+		NonceCount:     conf.Pool.NonceRange,
+		Key:            job.Block.Key,
+	}
+	poolMu.Unlock()
+	return s.send(poolMessage{Type: poolMsgJob, Job: &msg})
+}
+
+// refreshPoolJobs turn every new block for mining into a pool job
+func refreshPoolJobs() {
+	seen := make(map[uint64]*RespBlockWithKey)
+	for {
+		time.Sleep(200 * time.Millisecond)
+		mu.Lock()
+		var changed []*RespBlockWithKey
+		for c, block := range blocks {
+			if block != nil && seen[c] != block {
+				seen[c] = block
+				changed = append(changed, block)
+			}
+		}
+		mu.Unlock()
+
+		for _, block := range changed {
+			share := conf.Pool.ShareHashPower
+			if share == 0 {
+				share = 1
+				if block.HashpowerLimit > 7 {
+					share = block.HashpowerLimit - 6
+				}
+			}
+			if share > block.HashpowerLimit {
+				share = block.HashpowerLimit
+			}
+			poolMu.Lock()
+			poolNextID++
+			job := &poolJobState{
+				ID:         poolNextID,
+				Chain:      block.Chain,
+				Block:      block,
+				ShareLimit: share,
+				next:       rand.Uint64(),
+				seen:       make(map[uint64]bool),
+			}
+			poolJobs[job.ID] = job
+			poolCurrent[job.Chain] = job
+			// keep the jobs that late shares may still refer to
+			for id, old := range poolJobs {
+				if old.Chain == job.Chain && id+8 < job.ID {
+					delete(poolJobs, id)
+				}
+			}
+			var sessions []*poolSession
+			for s := range poolSessions {
+				if s.chain == job.Chain {
+					for id := range s.ranges {
+						if poolJobs[id] == nil {
+							delete(s.ranges, id)
+						}
+					}
+					sessions = append(sessions, s)
+				}
+			}
+			poolMu.Unlock()
+			for _, s := range sessions {
+				go s.assign(job)
+			}
+		}
+	}
+}
+
+// checkShare verify the share of the worker, post the block if it solves it
+func (s *poolSession) checkShare(share poolShare) poolResult {
+	rst := poolResult{JobID: share.JobID, Nonce: share.Nonce}
+	poolMu.Lock()
+	job := poolJobs[share.JobID]
+	inRange := false
+	for _, r := range s.ranges[share.JobID] {
+		if r[0] == share.RangeStart && r[1]-r[0] == share.RangeCount &&
+			share.Nonce-r[0] < r[1]-r[0] {
+			inRange = true
+		}
+	}
+	switch {
+	case job == nil:
+		rst.Reason = "unknown or stale job"
+	case !inRange:
+		rst.Reason = "nonce out of the assigned range"
+	case job.seen[share.Nonce]:
+		rst.Reason = "duplicate share"
+	default:
+		job.seen[share.Nonce] = true
+	}
+	poolMu.Unlock()
+	if rst.Reason != "" {
+		s.reject()
+		return rst
+	}
+
+	block := *job.Block
+	block.Nonce = share.Nonce
+	data := Encode(block.Block)
+	sign := wallet.Sign(block.Key, data)
+	val := []byte{wallet.SignLen}
+	val = append(val, sign...)
+	val = append(val, data...)
+	key := wallet.GetHash(val)
+	hp := getHashPower(key)
+	if hp < job.ShareLimit {
+		rst.Reason = fmt.Sprintf("hash power %d lower than %d", hp, job.ShareLimit)
+		s.reject()
+		return rst
+	}
+
+	rst.Accepted = true
+	poolMu.Lock()
+	unsafeWorkerStat(s.worker).Shares++
+	poolMu.Unlock()
+	ledgerAddShare(s.worker, job.Chain, job.ID, job.ShareLimit)
+	if hp < block.HashpowerLimit {
+		return rst
+	}
+
+	rst.Block = true
+	if conf.Verbosity >= 3 {
+		log.Printf("found_candidate worker:%s dev:%t from:%s chain:%d key:%x\n", s.worker, block.Dev, block.From, block.Chain, key)
+	}
+	mu.Lock()
+	if !block.Dev {
+		genBlockNum++
+	}
+	mu.Unlock()
+	if !block.Dev {
+		trackBlock(block.Chain, block.Index, key)
+	}
+	poolMu.Lock()
+	unsafeWorkerStat(s.worker).Blocks++
+	poolMu.Unlock()
+	if !block.Dev {
+		ledgerAddBlock(s.worker, block.Chain, key)
+	}
+	go submitBlock(block.Chain, block.From, key, val)
+	return rst
+}
+
+func (s *poolSession) reject() {
+	poolMu.Lock()
+	unsafeWorkerStat(s.worker).Rejected++
+	poolMu.Unlock()
+}
+
+func showPoolWorkers() {
+	if conf.Pool.Listen == "" {
+		fmt.Println("pool is not enabled")
+		return
+	}
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	var workers []string
+	var total uint64
+	for w, stat := range workerStats {
+		workers = append(workers, w)
+		if stat.Connected > 0 {
+			total += stat.Hashrate
+		}
+	}
+	sort.Strings(workers)
+	fmt.Printf("pool:%s, workers:%d, hashrate:%d\n", conf.Pool.Listen, len(workers), total)
+	for _, w := range workers {
+		stat := workerStats[w]
+		fmt.Printf("worker:%s, connected:%t, hashrate:%d, shares:%d, rejected:%d, blocks:%d, last seen:%s\n",
+			w, stat.Connected > 0, stat.Hashrate, stat.Shares, stat.Rejected, stat.Blocks, stat.LastSeen.Format("15:04:05"))
+	}
+}
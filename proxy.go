@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// noProxy the proxy setting that forces a direct connection
+const noProxy = "direct"
+
+// connectDialer dial through an HTTP proxy with the CONNECT method
+type connectDialer struct {
+	proxy   *url.URL
+	forward proxy.Dialer
+}
+
+func init() {
+	newConnect := func(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+		return &connectDialer{u, forward}, nil
+	}
+	proxy.RegisterDialerType("http", newConnect)
+	proxy.RegisterDialerType("https", newConnect)
+}
+
+func (d *connectDialer) Dial(network, addr string) (net.Conn, error) {
+	host := d.proxy.Host
+	if d.proxy.Port() == "" {
+		host = hostPort(d.proxy)
+	}
+	conn, err := d.forward.Dial(network, host)
+	if err != nil {
+		return nil, err
+	}
+	if d.proxy.Scheme == "https" {
+		cfg := tlsConfig.Clone()
+		cfg.ServerName = d.proxy.Hostname()
+		tc := tls.Client(conn, cfg)
+		if err = tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := d.proxy.User; user != nil {
+		pwd, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + pwd))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", d.proxy.Host, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// proxyURL the configured proxy of the server: server_proxy first, then proxy,
+// then HTTP_PROXY/HTTPS_PROXY/NO_PROXY. nil means no proxy.
+func proxyURL(server string) (*url.URL, error) {
+	setting, ok := conf.ServerProxy[server]
+	if !ok {
+		setting = conf.Proxy
+	}
+	if setting == noProxy {
+		return nil, nil
+	}
+	if setting != "" {
+		return url.Parse(setting)
+	}
+	u, err := serverURL(server)
+	if err != nil {
+		return nil, err
+	}
+	return httpproxy.FromEnvironment().ProxyFunc()(u)
+}
+
+// serverDialer dialer for raw connections to the server, through its proxy if any
+func serverDialer(server string) (proxy.Dialer, error) {
+	direct := &net.Dialer{Timeout: 10 * time.Second}
+	pu, err := proxyURL(server)
+	if err != nil {
+		return nil, err
+	}
+	if pu != nil {
+		return proxy.FromURL(pu, direct)
+	}
+	_, configured := conf.ServerProxy[server]
+	if !configured && conf.Proxy == "" && (os.Getenv("ALL_PROXY") != "" || os.Getenv("all_proxy") != "") {
+		return proxy.FromEnvironment(), nil
+	}
+	return direct, nil
+}
+
+// dialContext dial with the dialer until ctx is done. The proxy dialers of
+// x/net take no context, their late connections are closed.
+func dialContext(ctx context.Context, dialer proxy.Dialer, network, addr string) (net.Conn, error) {
+	if d, ok := dialer.(*net.Dialer); ok {
+		return d.DialContext(ctx, network, addr)
+	}
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan dialed, 1)
+	go func() {
+		conn, err := dialer.Dial(network, addr)
+		ch <- dialed{conn, err}
+	}()
+	select {
+	case d := <-ch:
+		return d.conn, d.err
+	case <-ctx.Done():
+		go func() {
+			if d := <-ch; d.conn != nil {
+				d.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+var clientMu sync.Mutex
+var clients map[string]*http.Client
+
+func init() {
+	clients = make(map[string]*http.Client)
+}
+
+// clientFor http client of the server, using its proxy. If the proxy cannot
+// be set up, the client refuses to connect rather than going around it.
+func clientFor(server string) *http.Client {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	if c := clients[server]; c != nil {
+		return c
+	}
+	transport := &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	pu, err := proxyURL(server)
+	var dialer proxy.Dialer
+	if err == nil && (pu == nil || pu.Scheme != "http" && pu.Scheme != "https") {
+		// socks proxies and direct connections go through the dialer
+		dialer, err = serverDialer(server)
+	}
+	switch {
+	case err != nil:
+		log.Printf("fail to set up the proxy of %s, not connecting to it: %v\n", server, err)
+		err = fmt.Errorf("proxy of %s: %v", server, err)
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, err
+		}
+	case dialer != nil:
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialContext(ctx, dialer, network, addr)
+		}
+	default:
+		transport.Proxy = http.ProxyURL(pu)
+		transport.DialContext = (&net.Dialer{Timeout: 10 * time.Second}).DialContext
+	}
+	c := &http.Client{Transport: transport}
+	clients[server] = c
+	return c
+}
+
+// checkProxies make sure every configured proxy can be used
+func checkProxies() error {
+	settings := []string{conf.Proxy}
+	for _, setting := range conf.ServerProxy {
+		settings = append(settings, setting)
+	}
+	for _, setting := range settings {
+		if setting == "" || setting == noProxy {
+			continue
+		}
+		u, err := url.Parse(setting)
+		if err != nil {
+			return err
+		}
+		if _, err = proxy.FromURL(u, proxy.Direct); err != nil {
+			return fmt.Errorf("unsupported proxy %s: %v", setting, err)
+		}
+	}
+	return nil
+}
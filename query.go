@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// queryData print the value of app/structName/key on the chain. raw asks for
+// the bytes of the value, else for the DataInfo with its life.
+func queryData(chain uint64, app, structName, key string, raw bool) error {
+	if _, err := hex.DecodeString(key); err != nil {
+		return fmt.Errorf("the key must be hex: %s", key)
+	}
+	c := NewNodeClient(conf.Servers[0])
+	var val []byte
+	var life uint64
+	if raw {
+		data, err := c.Data(context.Background(), chain, app, structName, key)
+		if err != nil {
+			return err
+		}
+		val = data
+	} else {
+		info, err := c.DataInfo(context.Background(), chain, app, structName, key)
+		if err != nil {
+			return err
+		}
+		if val, err = hex.DecodeString(info.Value); err != nil {
+			return fmt.Errorf("invalid value from %s: %s", c.Server, info.Value)
+		}
+		life = info.Life
+	}
+	if app == "" {
+		app = CoreApp
+	}
+	fmt.Printf("chain:%d, app:%s, struct:%s, key:%s\n", chain, app, structName, key)
+	fmt.Printf("value:%x (%d bytes)\n", val, len(val))
+	if life > 0 {
+		fmt.Printf("life: until %s\n", time.Unix(0, int64(life)*int64(time.Millisecond)).Format(time.RFC3339))
+	}
+	decoded, err := decodeCoreData(app, structName, val)
+	if err != nil {
+		return err
+	}
+	if decoded != nil {
+		fmt.Printf("%s: %s\n", structName, decoded)
+	}
+	return nil
+}
+
+// cmdQuery print any data of the node, return the exit code
+func cmdQuery(args []string) int {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	chain := fs.Uint64("chain", 0, "chain to query, default the first of chains")
+	app := fs.String("app", "", "name of the app, default the core app")
+	structName := fs.String("struct", "dbCoin", "name of the struct, like dbCoin, dbMiner or statMining")
+	key := fs.String("key", "", "key (hex), default the wallet address")
+	raw := fs.Bool("raw", false, "ask for the raw value instead of the data info")
+	fs.Parse(args)
+	if *chain == 0 {
+		*chain = defaultChain()
+	}
+	if *key == "" {
+		*key = userAddrStr
+	}
+	if err := queryData(*chain, *app, *structName, *key, *raw); err != nil {
+		fmt.Printf("chain:%d, fail to query %s/%s: %v\n", *chain, *structName, *key, err)
+		return 1
+	}
+	return 0
+}
+
+// menuQuery ask for the data to print
+func menuQuery() {
+	var chain uint64
+	var app, structName, key, raw string
+	fmt.Print("chain, 0 for the first of chains:")
+	fmt.Scanln(&chain)
+	fmt.Print("app, empty for the core app:")
+	fmt.Scanln(&app)
+	fmt.Print("struct, like dbCoin, dbMiner or statMining:")
+	fmt.Scanln(&structName)
+	fmt.Print("key (hex), empty for the wallet address:")
+	fmt.Scanln(&key)
+	fmt.Print("raw value? (y/n):")
+	fmt.Scanln(&raw)
+	if chain == 0 {
+		chain = defaultChain()
+	}
+	if key == "" {
+		key = userAddrStr
+	}
+	if err := queryData(chain, app, structName, key, raw == "y"); err != nil {
+		fmt.Printf("chain:%d, fail to query %s/%s: %v\n", chain, structName, key, err)
+	}
+}
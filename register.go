@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math"
+	"time"
+)
+
+// govmUnit the number of the smallest unit in one govm
+const govmUnit = 1000000000
+
+func toGovm(v uint64) float64 {
+	return float64(v) / govmUnit
+}
+
+func fromGovm(v float64) uint64 {
+	return uint64(math.Round(v * govmUnit))
+}
+
+// cmdRegisterMiner register the wallet as a miner of a chain, wait until dbMiner
+// shows it. Return the exit code.
+func cmdRegisterMiner(args []string) int {
+	fs := flag.NewFlagSet("register-miner", flag.ExitOnError)
+	chain := fs.Uint64("chain", 0, "chain to register on, default the first of chains")
+	index := fs.Uint64("index", 0, "index of the block to mine from, default 50 blocks after the last one")
+	cost := fs.Float64("cost", 0, "govm to pay, default 3 times of the guerdon")
+	wait := fs.Duration("wait", 30*time.Minute, "how long to wait for the registration to show up")
+	fs.Parse(args)
+	if *chain == 0 {
+		*chain = defaultChain()
+	}
+
+	ok, err := isMiner(*chain, conf.Servers[0], userAddrStr)
+	if err != nil {
+		fmt.Printf("fail to check miner %s on chain %d: %v\n", userAddrStr, *chain, err)
+		return 1
+	}
+	if ok {
+		fmt.Printf("%s is already a miner on chain %d\n", userAddrStr, *chain)
+		return 0
+	}
+	trans, err := buildRegisterMiner(*chain, userAddress, *index, fromGovm(*cost))
+	if err != nil {
+		fmt.Printf("chain:%d, %v\n", *chain, err)
+		return 1
+	}
+	if err = trans.SetSign(userKey, wal.SignPrefix); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	data, key := trans.Output()
+	if err = broadcastTransaction(*chain, data); err != nil {
+		fmt.Printf("chain:%d, fail to send the registration: %v\n", *chain, err)
+		return 1
+	}
+	fmt.Printf("chain:%d, registration sent, %s, transaction:%x\n", *chain, describeTransaction(trans), key)
+
+	deadline := time.Now().Add(*wait)
+	for time.Now().Before(deadline) {
+		time.Sleep(10 * time.Second)
+		ok, err = isMiner(*chain, conf.Servers[0], userAddrStr)
+		if err != nil {
+			fmt.Printf("chain:%d, fail to check miner: %v\n", *chain, err)
+			continue
+		}
+		if ok {
+			fmt.Printf("chain:%d, %s is a miner now\n", *chain, userAddrStr)
+			return 0
+		}
+		fmt.Printf("chain:%d, waiting for the registration...\n", *chain)
+	}
+	fmt.Printf("chain:%d, the registration did not show up within %s, transaction:%x\n", *chain, *wait, key)
+	return 1
+}
+
+// buildRegisterMiner the unsigned registration of user as a miner of the chain.
+// cost 0 means 3 times of the guerdon, index 0 means 50 blocks after the last one.
+func buildRegisterMiner(chain uint64, user []byte, index, cost uint64) (*Transaction, error) {
+	ctx := context.Background()
+	c := NewNodeClient(conf.Servers[0])
+	guerdon, err := getGuerdon(ctx, c, chain)
+	if err != nil {
+		return nil, fmt.Errorf("fail to get the guerdon: %v", err)
+	}
+	if cost == 0 {
+		cost = 3 * guerdon
+	}
+	if cost < 3*guerdon {
+		return nil, fmt.Errorf("cost %.3f govm is lower than 3 times of the guerdon (%.3f govm)", toGovm(cost), toGovm(guerdon))
+	}
+	coins, err := getCoins(ctx, c, chain, hex.EncodeToString(user))
+	if err != nil {
+		return nil, fmt.Errorf("fail to get balance: %v", err)
+	}
+	// the energy is paid from the balance too
+	if coins < cost+txEnergy {
+		return nil, fmt.Errorf("balance %.3f govm is lower than the cost %.3f govm plus the energy %.3f govm",
+			toGovm(coins), toGovm(cost), toGovm(txEnergy))
+	}
+	if index == 0 {
+		last, err := c.BlockInfo(ctx, chain, 0)
+		if err != nil {
+			return nil, fmt.Errorf("fail to get the last block: %v", err)
+		}
+		index = last.Index + 50
+	}
+	trans := NewTransaction(chain, user)
+	trans.CreateRegisterMiner(0, index, cost)
+	return trans, nil
+}
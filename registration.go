@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// pausedChains the chains that are not mined because the wallet is not a
+// registered miner of them, the reason per chain. Guarded by mu
+var pausedChains map[uint64]string
+
+func init() {
+	pausedChains = make(map[uint64]string)
+}
+
+// minerQuorum ask all servers in parallel whether addr is a miner of the chain.
+// The answer of most servers counts once more than half of the servers answered.
+func minerQuorum(chain uint64, addr string) (bool, error) {
+	type answer struct {
+		ok  bool
+		err error
+	}
+	answers := make(chan answer, len(conf.Servers))
+	for _, server := range conf.Servers {
+		go func(s string) {
+			ok, err := isMiner(chain, s, addr)
+			answers <- answer{ok, err}
+		}(server)
+	}
+	var yes, no int
+	var lastErr error
+	for range conf.Servers {
+		a := <-answers
+		switch {
+		case a.err != nil:
+			lastErr = a.err
+		case a.ok:
+			yes++
+		default:
+			no++
+		}
+	}
+	quorum := len(conf.Servers)/2 + 1
+	switch {
+	case yes+no < quorum:
+		return false, fmt.Errorf("%d of %d servers answered, last error: %v", yes+no, len(conf.Servers), lastErr)
+	case yes == no:
+		return false, fmt.Errorf("%d servers say it is a miner, %d say it is not", yes, no)
+	}
+	return yes > no, nil
+}
+
+// checkRegistration whether the wallet, and the dev wallet, are miners of the chain.
+// "" if they are, else why the chain should be paused.
+func checkRegistration(chain uint64) (string, error) {
+	addrs := []string{userAddrStr}
+	if devAddrStr != userAddrStr {
+		addrs = append(addrs, devAddrStr)
+	}
+	for _, addr := range addrs {
+		ok, err := minerQuorum(chain, addr)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return fmt.Sprintf("%s is not a miner, register it with: register-miner -chain %d", addr, chain), nil
+		}
+	}
+	return "", nil
+}
+
+// checkRegistrations check all chains in parallel, pause the chains that the
+// wallet is not a miner of and resume the others. A chain that cannot be
+// checked keeps its state.
+func checkRegistrations() {
+	var wg sync.WaitGroup
+	for _, chain := range activeChains() {
+		wg.Add(1)
+		go func(c uint64) {
+			defer wg.Done()
+			reason, err := checkRegistration(c)
+			if err != nil {
+				log.Printf("chain:%d, fail to check miner registration: %v\n", c, err)
+				return
+			}
+			setPaused(c, reason)
+		}(chain)
+	}
+	wg.Wait()
+}
+
+// setPaused pause the chain for the reason, resume it if reason is ""
+func setPaused(chain uint64, reason string) {
+	mu.Lock()
+	defer mu.Unlock()
+	old, paused := pausedChains[chain]
+	switch {
+	case reason != "" && !paused:
+		log.Printf("chain:%d, paused: %s\n", chain, reason)
+		pausedChains[chain] = reason
+		blockFlag++
+	case reason != "" && old != reason:
+		pausedChains[chain] = reason
+	case reason == "" && paused:
+		log.Printf("chain:%d, the wallet is a miner again, resumed\n", chain)
+		delete(pausedChains, chain)
+		blockFlag++
+	}
+}
+
+// chainPaused why the chain is paused, "" if it is mined
+func chainPaused(chain uint64) string {
+	mu.Lock()
+	defer mu.Unlock()
+	return pausedChains[chain]
+}
+
+// watchRegistrations check the registrations every RegistrationCheckSec, never returns
+func watchRegistrations() {
+	for {
+		time.Sleep(time.Duration(conf.RegistrationCheckSec) * time.Second)
+		checkRegistrations()
+	}
+}
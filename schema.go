@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Coins the value of dbCoin, keyed by address
+type Coins struct {
+	Balance uint64
+}
+
+func (c *Coins) String() string {
+	return fmt.Sprintf("balance: %.3f govm", toGovm(c.Balance))
+}
+
+// regMiner a registration of a miner, like core.syncRegMiner
+type regMiner struct {
+	Index uint64
+	Cost  uint64
+	User  Address
+}
+
+// MinerRecord the value of dbMiner, keyed by address. Only its presence tells
+// that the address is registered: the layout is a regMiner, or only the cost
+// like the miner_register records of the node, anything else stays in Raw.
+type MinerRecord struct {
+	regMiner
+	HasIndex bool
+	Raw      []byte
+	// Life the time in milliseconds until the registration expires
+	Life uint64
+}
+
+// decodeMinerRecord decode the value of dbMiner as far as its layout is known
+func decodeMinerRecord(val []byte, life uint64) *MinerRecord {
+	m := &MinerRecord{Life: life}
+	switch len(val) {
+	case binary.Size(m.regMiner):
+		Decode(val, &m.regMiner)
+		m.HasIndex = true
+	case binary.Size(m.Cost):
+		Decode(val, &m.Cost)
+	default:
+		m.Raw = val
+	}
+	return m
+}
+
+func (m *MinerRecord) String() string {
+	var out string
+	switch {
+	case m.Raw != nil:
+		out = fmt.Sprintf("registration: %x", m.Raw)
+	case m.HasIndex:
+		out = fmt.Sprintf("from block %d, cost: %.3f govm", m.Index, toGovm(m.Cost))
+		if m.User != (Address{}) {
+			out += fmt.Sprintf(", address: %x", m.User)
+		}
+	default:
+		out = fmt.Sprintf("cost: %.3f govm", toGovm(m.Cost))
+	}
+	if m.Life > 0 {
+		out += ", until " + time.Unix(0, int64(m.Life)*int64(time.Millisecond)).Format(time.RFC3339)
+	}
+	return out
+}
+
+// minerNum the miners of a block in dbMining, like core
+const minerNum = 11
+
+// Miners the value of dbMining, keyed by the encoded index of a block: the
+// registered miners of the block, ordered by cost, like core.Miner
+type Miners struct {
+	Miner [minerNum]Address
+	Cost  [minerNum]uint64
+}
+
+func (m *Miners) String() string {
+	var items []string
+	for i, addr := range m.Miner {
+		if addr != (Address{}) {
+			items = append(items, fmt.Sprintf("%x(%.3f govm)", addr, toGovm(m.Cost[i])))
+		}
+	}
+	if len(items) == 0 {
+		return "no miners"
+	}
+	return "miners: " + strings.Join(items, ", ")
+}
+
+// MiningStat the value of statMining, keyed by address
+type MiningStat struct {
+	Blocks uint64
+}
+
+func (s *MiningStat) String() string {
+	return fmt.Sprintf("mined blocks: %d", s.Blocks)
+}
+
+// Stat an int value of dbStat, keyed by the id of the stat, like StatGuerdon.
+// Some stats, like StatBaseInfo, are structs.
+type Stat struct {
+	Value uint64
+}
+
+func (s *Stat) String() string {
+	return fmt.Sprintf("value: %d", s.Value)
+}
+
+// coreSchemas the known structs of the core app, by struct name
+var coreSchemas map[string]func() fmt.Stringer
+
+func init() {
+	coreSchemas = map[string]func() fmt.Stringer{
+		"dbCoin":     func() fmt.Stringer { return new(Coins) },
+		"dbMining":   func() fmt.Stringer { return new(Miners) },
+		"statMining": func() fmt.Stringer { return new(MiningStat) },
+		"dbStat":     func() fmt.Stringer { return new(Stat) },
+	}
+}
+
+// decodeExact decode the whole value into out, an error if the size does not match
+func decodeExact(structName string, val []byte, out interface{}) error {
+	if size := binary.Size(out); size != len(val) {
+		return fmt.Errorf("invalid %s, %d bytes instead of %d: %x", structName, len(val), size, val)
+	}
+	Decode(val, out)
+	return nil
+}
+
+// decodeCoreData decode the value of a struct of the core app into its type.
+// nil without error if the struct is not known.
+func decodeCoreData(app, structName string, val []byte) (fmt.Stringer, error) {
+	newValue := coreSchemas[structName]
+	if (app != "" && app != CoreApp) || newValue == nil {
+		return nil, nil
+	}
+	out := newValue()
+	if err := decodeExact(structName, val, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// getCoreData the value of a struct of the core app decoded into out, ErrNotFound if it is empty
+func getCoreData(ctx context.Context, c *NodeClient, chain uint64, structName, key string, out interface{}) error {
+	val, err := c.Data(ctx, chain, "", structName, key)
+	if err != nil {
+		return err
+	}
+	return decodeExact(structName, val, out)
+}
+
+// getMinerRecord the registration of addr as a miner of the chain, ErrNotFound if it is not a miner
+func getMinerRecord(ctx context.Context, c *NodeClient, chain uint64, addr string) (*MinerRecord, error) {
+	info, err := c.DataInfo(ctx, chain, "", "dbMiner", addr)
+	if err != nil {
+		return nil, err
+	}
+	val, err := hex.DecodeString(info.Value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dbMiner from %s: %s", c.Server, info.Value)
+	}
+	return decodeMinerRecord(val, info.Life), nil
+}
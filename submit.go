@@ -0,0 +1,207 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// submitOrigin post the solution only to the server that delivered the job
+	submitOrigin = "origin"
+	// submitAll post the solution to all configured servers in parallel
+	submitAll = "all"
+	// submitFirstN post the solution to the first N healthy servers
+	submitFirstN = "first_n"
+)
+
+type submitResult struct {
+	Server  string
+	Latency time.Duration
+	Err     error
+}
+
+// submission the results of posting one candidate block
+type submission struct {
+	Chain   uint64
+	Key     []byte
+	Time    time.Time
+	First   string
+	Results []submitResult
+}
+
+type submitStat struct {
+	Submits       uint64
+	Accepted      uint64
+	FirstAccepted uint64
+	TotalLatency  time.Duration
+	LastLatency   time.Duration
+}
+
+var submitMu sync.Mutex
+var submitStats map[string]*submitStat
+var recentSubmissions *list.List
+
+// connServers servers with a live mining websocket, per chain
+var connServers map[uint64]map[string]time.Time
+
+func init() {
+	submitStats = make(map[string]*submitStat)
+	recentSubmissions = list.New()
+	connServers = make(map[uint64]map[string]time.Time)
+}
+
+// unsafeSetConnected must be called with mu held
+func unsafeSetConnected(chain uint64, server string, connected bool) {
+	if connServers[chain] == nil {
+		connServers[chain] = make(map[string]time.Time)
+	}
+	if connected {
+		connServers[chain][server] = time.Now()
+	} else {
+		delete(connServers[chain], server)
+	}
+}
+
+// submitTargets the servers that a solution for the job from origin is posted to
+func submitTargets(chain uint64, origin string) []string {
+	switch conf.SubmitStrategy {
+	case submitAll:
+		return conf.Servers
+	case submitFirstN:
+		n := conf.SubmitServerNum
+		if n <= 0 {
+			n = 1
+		}
+		out := []string{origin}
+		var others []string
+		for _, server := range conf.Servers {
+			if server != origin && !breakerOpen(server) {
+				others = append(others, server)
+			}
+		}
+		scores := make(map[string]float64)
+		for _, server := range others {
+			scores[server] = serverScore(server)
+		}
+		mu.Lock()
+		connected := make(map[string]bool)
+		for server := range connServers[chain] {
+			connected[server] = true
+		}
+		mu.Unlock()
+		// best scored first, a live mining websocket breaks ties
+		sort.SliceStable(others, func(i, j int) bool {
+			a, b := others[i], others[j]
+			if scores[a] != scores[b] {
+				return scores[a] > scores[b]
+			}
+			return connected[a] && !connected[b]
+		})
+		for _, server := range others {
+			if len(out) >= n {
+				break
+			}
+			out = append(out, server)
+		}
+		return out
+	default:
+		return []string{origin}
+	}
+}
+
+// submitBlock post the solution according to conf.SubmitStrategy and record the results
+func submitBlock(chain uint64, origin string, key, data []byte) *submission {
+	sub := postSolution(chain, origin, key, data)
+
+	submitMu.Lock()
+	for _, rst := range sub.Results {
+		stat := submitStats[rst.Server]
+		if stat == nil {
+			stat = new(submitStat)
+			submitStats[rst.Server] = stat
+		}
+		stat.Submits++
+		stat.LastLatency = rst.Latency
+		stat.TotalLatency += rst.Latency
+		if rst.Err == nil {
+			stat.Accepted++
+		}
+		if rst.Server == sub.First {
+			stat.FirstAccepted++
+		}
+	}
+	if recentSubmissions.Len() >= 10 {
+		recentSubmissions.Remove(recentSubmissions.Front())
+	}
+	recentSubmissions.PushBack(*sub)
+	submitMu.Unlock()
+
+	if conf.Verbosity >= 3 {
+		log.Printf("submitted chain:%d key:%x first:%s %s\n", chain, key, sub.First, sub.describe())
+	}
+	return sub
+}
+
+// postSolution post the solution like submitBlock without recording anything, for
+// solutions that were not found by this process
+func postSolution(chain uint64, origin string, key, data []byte) *submission {
+	targets := submitTargets(chain, origin)
+	start := time.Now()
+	results := make(chan submitResult, len(targets))
+	for _, server := range targets {
+		go func(s string) {
+			err := NewNodeClient(s).PostBlock(context.Background(), chain, key, data)
+			results <- submitResult{s, time.Since(start), err}
+		}(server)
+	}
+
+	sub := submission{Chain: chain, Key: key, Time: start}
+	for range targets {
+		rst := <-results
+		if sub.First == "" && rst.Err == nil {
+			sub.First = rst.Server
+		}
+		sub.Results = append(sub.Results, rst)
+	}
+	return &sub
+}
+
+func (s submission) describe() string {
+	var items []string
+	for _, rst := range s.Results {
+		switch e := rst.Err.(type) {
+		case nil:
+			items = append(items, fmt.Sprintf("%s=%dms(ok)", rst.Server, rst.Latency.Milliseconds()))
+		case *ServerError:
+			items = append(items, fmt.Sprintf("%s=%dms(%d)", rst.Server, rst.Latency.Milliseconds(), e.Status))
+		default:
+			items = append(items, fmt.Sprintf("%s=%dms(error)", rst.Server, rst.Latency.Milliseconds()))
+		}
+	}
+	return strings.Join(items, ", ")
+}
+
+func showSubmissions() {
+	submitMu.Lock()
+	defer submitMu.Unlock()
+	fmt.Printf("strategy:%s\n", conf.SubmitStrategy)
+	for server, stat := range submitStats {
+		var avg time.Duration
+		if stat.Submits > 0 {
+			avg = stat.TotalLatency / time.Duration(stat.Submits)
+		}
+		fmt.Printf("server:%s, submits:%d, accepted:%d, first:%d, latency avg:%dms last:%dms\n",
+			server, stat.Submits, stat.Accepted, stat.FirstAccepted, avg.Milliseconds(), stat.LastLatency.Milliseconds())
+	}
+	for e := recentSubmissions.Front(); e != nil; e = e.Next() {
+		sub := e.Value.(submission)
+		fmt.Printf("%s chain:%d key:%x... first:%s %s\n",
+			sub.Time.Format("15:04:05"), sub.Chain, sub.Key[:8], sub.First, sub.describe())
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	connConnecting = "connecting"
+	connConnected  = "connected"
+	connBackingOff = "backing off"
+	connStopped    = "stopped"
+)
+
+// connSlot one of the KeepConnServerNum connections of a chain
+type connSlot struct {
+	mu     sync.Mutex
+	Server string
+	State  string
+	Since  time.Time
+}
+
+func (s *connSlot) set(server, state string) {
+	s.mu.Lock()
+	s.Server = server
+	s.State = state
+	s.Since = time.Now()
+	s.mu.Unlock()
+}
+
+// chainSupervisor keeps the mining websockets of one chain alive
+type chainSupervisor struct {
+	chain  uint64
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	slots  []*connSlot
+}
+
+// breaker circuit breaker of a server, open after too many connect failures in a row
+type breaker struct {
+	Failures  int
+	OpenUntil time.Time
+}
+
+var supervisorMu sync.Mutex
+var supervisors map[uint64]*chainSupervisor
+
+var breakerMu sync.Mutex
+var breakers map[string]*breaker
+
+func init() {
+	supervisors = make(map[uint64]*chainSupervisor)
+	breakers = make(map[string]*breaker)
+}
+
+// startSupervisor connect the chain to KeepConnServerNum servers
+func startSupervisor(chain uint64) {
+	supervisorMu.Lock()
+	defer supervisorMu.Unlock()
+	if supervisors[chain] != nil {
+		return
+	}
+	s := &chainSupervisor{chain: chain}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	for i := 0; i < conf.KeepConnServerNum; i++ {
+		slot := &connSlot{State: connConnecting, Since: time.Now()}
+		s.slots = append(s.slots, slot)
+		s.wg.Add(1)
+		go s.run(slot)
+	}
+	supervisors[chain] = s
+}
+
+// stopSupervisor close all connections of the chain and wait for them
+func stopSupervisor(chain uint64) {
+	supervisorMu.Lock()
+	s := supervisors[chain]
+	delete(supervisors, chain)
+	supervisorMu.Unlock()
+	if s == nil {
+		return
+	}
+	s.cancel()
+	s.wg.Wait()
+}
+
+func stopAllSupervisors() {
+	supervisorMu.Lock()
+	var chains []uint64
+	for c := range supervisors {
+		chains = append(chains, c)
+	}
+	supervisorMu.Unlock()
+	for _, c := range chains {
+		stopSupervisor(c)
+	}
+}
+
+func (s *chainSupervisor) run(slot *connSlot) {
+	defer s.wg.Done()
+	var attempt uint
+	var avoid string
+	for {
+		server := pickServer(s.chain, avoid)
+		avoid = ""
+		if server != "" {
+			slot.set(server, connConnecting)
+			connected, err := requestBlock(s.ctx, s.chain, server, slot)
+			releaseServer(s.chain, server)
+			recordBreaker(server, connected)
+			if err == errHalfOpen && s.ctx.Err() == nil {
+				// try another server right away
+				log.Printf("chain:%d, server %s stopped responding\n", s.chain, server)
+				avoid = server
+				continue
+			}
+			if connected {
+				attempt = 0
+				log.Printf("chain:%d, disconnected from server: %s, %v\n", s.chain, server, err)
+			} else if s.ctx.Err() == nil {
+				log.Printf("chain:%d, fail to connect to server: %s, %v\n", s.chain, server, err)
+			}
+		}
+		if s.ctx.Err() != nil {
+			slot.set("", connStopped)
+			return
+		}
+
+		wait := backoff(attempt)
+		attempt++
+		slot.set(server, connBackingOff)
+		select {
+		case <-s.ctx.Done():
+			slot.set("", connStopped)
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// backoff exponential backoff with jitter, between half and all of min*2^attempt
+func backoff(attempt uint) time.Duration {
+	minWait := time.Duration(conf.ReconnectMinSec) * time.Second
+	maxWait := time.Duration(conf.ReconnectMaxSec) * time.Second
+	wait := maxWait
+	if attempt < 16 && minWait<<attempt < maxWait {
+		wait = minWait << attempt
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+func recordBreaker(server string, connected bool) {
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	b := breakers[server]
+	if b == nil {
+		b = new(breaker)
+		breakers[server] = b
+	}
+	if connected {
+		b.Failures = 0
+		return
+	}
+	b.Failures++
+	if b.Failures >= conf.BreakerFailures {
+		b.OpenUntil = time.Now().Add(time.Duration(conf.BreakerCooldown) * time.Second)
+		b.Failures = 0
+		log.Printf("server %s failed too often, not using it until %s\n", server, b.OpenUntil.Format("15:04:05"))
+	}
+}
+
+func breakerOpen(server string) bool {
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	b := breakers[server]
+	return b != nil && time.Now().Before(b.OpenUntil)
+}
+
+func showConnections() {
+	supervisorMu.Lock()
+	var chains []uint64
+	for c := range supervisors {
+		chains = append(chains, c)
+	}
+	sort.Slice(chains, func(i, j int) bool { return chains[i] < chains[j] })
+	var list []*chainSupervisor
+	for _, c := range chains {
+		list = append(list, supervisors[c])
+	}
+	supervisorMu.Unlock()
+
+	for _, s := range list {
+		for _, slot := range s.slots {
+			slot.mu.Lock()
+			fmt.Printf("chain:%d, server:%s, state:%s, for:%s\n",
+				s.chain, slot.Server, slot.State, time.Since(slot.Since).Truncate(time.Second))
+			slot.mu.Unlock()
+		}
+	}
+	for _, server := range conf.Servers {
+		if breakerOpen(server) {
+			fmt.Printf("server:%s, circuit breaker open\n", server)
+		}
+	}
+}
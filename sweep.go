@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// SweepConfig move the balance of the mining wallet to a cold address
+type SweepConfig struct {
+	ColdAddress string `json:"cold_address,omitempty"`
+	// Threshold sweep once the balance of a chain reaches it, govm
+	Threshold float64 `json:"threshold,omitempty"`
+	// Reserve what stays in the mining wallet, govm
+	Reserve float64 `json:"reserve,omitempty"`
+	// DailyLimit the most govm swept per chain in 24 hours, 0 means no limit
+	DailyLimit float64 `json:"daily_limit,omitempty"`
+	// DailySweeps the most sweeps per chain in 24 hours
+	DailySweeps int    `json:"daily_sweeps,omitempty"`
+	IntervalSec uint   `json:"interval_sec,omitempty"`
+	LogFile     string `json:"log_file,omitempty"`
+}
+
+// sweep statuses in the log
+const (
+	sweepSent      = "sent"
+	sweepConfirmed = "confirmed"
+	sweepFailed    = "failed"
+)
+
+// sweepRecord one line of the sweep log
+type sweepRecord struct {
+	Time   time.Time `json:"time"`
+	Chain  uint64    `json:"chain"`
+	To     string    `json:"to"`
+	Amount uint64    `json:"amount"`
+	Key    string    `json:"key,omitempty"`
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+}
+
+var sweepMu sync.Mutex
+var sweepLog *os.File
+
+// sweepSentRecords the sweeps sent in the last 24 hours, per chain
+var sweepSentRecords map[uint64][]sweepRecord
+
+// sweepPending the chains with a sweep waiting for its confirmation
+var sweepPending map[uint64]bool
+
+func init() {
+	sweepSentRecords = make(map[uint64][]sweepRecord)
+	sweepPending = make(map[uint64]bool)
+}
+
+// checkSweepConfig must be called after the defaults are set
+func checkSweepConfig() error {
+	s := &conf.Sweep
+	if _, err := parseAddress(s.ColdAddress); err != nil {
+		return err
+	}
+	if s.Threshold <= 0 {
+		return fmt.Errorf("threshold must be positive")
+	}
+	if s.Reserve < 0 || s.Reserve >= s.Threshold {
+		return fmt.Errorf("reserve must be lower than the threshold")
+	}
+	// the energy of the sweep is paid from what stays
+	if fromGovm(s.Reserve) < txEnergy {
+		return fmt.Errorf("reserve must cover the energy of the transfer, at least %.3f govm", toGovm(txEnergy))
+	}
+	if s.DailyLimit < 0 {
+		return fmt.Errorf("daily_limit must not be negative")
+	}
+	return nil
+}
+
+// startSweeper load the sweep log and check the balances every IntervalSec
+func startSweeper() error {
+	if cold, _ := parseAddress(conf.Sweep.ColdAddress); bytes.Equal(cold[:], userAddress) {
+		return fmt.Errorf("the cold address is the mining wallet")
+	}
+	f, err := os.OpenFile(conf.Sweep.LogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r sweepRecord
+		if json.Unmarshal(scanner.Bytes(), &r) == nil && r.Status == sweepSent {
+			sweepSentRecords[r.Chain] = append(sweepSentRecords[r.Chain], r)
+		}
+	}
+	sweepLog = f
+
+	go func() {
+		for {
+			for _, chain := range activeChains() {
+				sweepChain(chain)
+			}
+			time.Sleep(time.Duration(conf.Sweep.IntervalSec) * time.Second)
+		}
+	}()
+	fmt.Printf("sweeping balances above %.3f govm to %s\n", conf.Sweep.Threshold, conf.Sweep.ColdAddress)
+	return nil
+}
+
+// unsafeWriteSweep must be called with sweepMu held
+func unsafeWriteSweep(r sweepRecord) {
+	if r.Status == sweepSent {
+		sweepSentRecords[r.Chain] = append(sweepSentRecords[r.Chain], r)
+	}
+	log.Printf("sweep chain:%d to:%s amount:%.3f govm status:%s %s %s\n",
+		r.Chain, r.To, toGovm(r.Amount), r.Status, r.Key, r.Error)
+	data, _ := json.Marshal(r)
+	if _, err := sweepLog.Write(append(data, '\n')); err != nil {
+		log.Println("fail to write the sweep log:", err)
+	}
+}
+
+// unsafeSweptToday must be called with sweepMu held, the amount and number of
+// the sweeps of the chain in the last 24 hours
+func unsafeSweptToday(chain uint64) (uint64, int) {
+	var amount uint64
+	var recent []sweepRecord
+	for _, r := range sweepSentRecords[chain] {
+		if time.Since(r.Time) < 24*time.Hour {
+			recent = append(recent, r)
+			amount += r.Amount
+		}
+	}
+	sweepSentRecords[chain] = recent
+	return amount, len(recent)
+}
+
+// sweepChain transfer everything above the reserve once the balance reaches the threshold
+func sweepChain(chain uint64) {
+	sweepMu.Lock()
+	pending := sweepPending[chain]
+	sweptAmount, sweeps := unsafeSweptToday(chain)
+	sweepMu.Unlock()
+	if pending {
+		return
+	}
+
+	coins, err := getCoins(context.Background(), NewNodeClient(conf.Servers[0]), chain, userAddrStr)
+	if err != nil {
+		log.Printf("sweep chain:%d, fail to get balance: %v\n", chain, err)
+		return
+	}
+	if coins < fromGovm(conf.Sweep.Threshold) {
+		return
+	}
+	if conf.Sweep.DailySweeps > 0 && sweeps >= conf.Sweep.DailySweeps {
+		if conf.Verbosity >= 3 {
+			log.Printf("sweep chain:%d, %d sweeps in 24 hours, waiting\n", chain, sweeps)
+		}
+		return
+	}
+	amount := coins - fromGovm(conf.Sweep.Reserve)
+	if limit := fromGovm(conf.Sweep.DailyLimit); limit > 0 {
+		if sweptAmount >= limit {
+			if conf.Verbosity >= 3 {
+				log.Printf("sweep chain:%d, daily limit reached, waiting\n", chain)
+			}
+			return
+		}
+		if amount > limit-sweptAmount {
+			amount = limit - sweptAmount
+		}
+	}
+
+	payee, _ := parseAddress(conf.Sweep.ColdAddress)
+	r := sweepRecord{Time: time.Now(), Chain: chain, To: conf.Sweep.ColdAddress, Amount: amount}
+	key, err := sendTransfer(chain, payee, amount)
+	sweepMu.Lock()
+	if err != nil {
+		r.Status = sweepFailed
+		r.Error = err.Error()
+		unsafeWriteSweep(r)
+		sweepMu.Unlock()
+		return
+	}
+	r.Key = fmt.Sprintf("%x", key)
+	r.Status = sweepSent
+	unsafeWriteSweep(r)
+	sweepPending[chain] = true
+	sweepMu.Unlock()
+
+	go func() {
+		_, err := waitTransaction(chain, key, 30*time.Minute)
+		r.Time = time.Now()
+		r.Status = sweepConfirmed
+		if err != nil {
+			r.Status = sweepFailed
+			r.Error = err.Error()
+		}
+		sweepMu.Lock()
+		unsafeWriteSweep(r)
+		delete(sweepPending, chain)
+		sweepMu.Unlock()
+	}()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// parseAddress the wallet address in hex
+func parseAddress(s string) (Address, error) {
+	var addr Address
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != AddressLen {
+		return addr, fmt.Errorf("invalid address: %s", s)
+	}
+	copy(addr[:], b)
+	return addr, nil
+}
+
+// buildTransfer the unsigned transfer of value from user to payee, after checking the balance
+func buildTransfer(chain uint64, user []byte, payee Address, value uint64) (*Transaction, error) {
+	if value == 0 {
+		return nil, fmt.Errorf("nothing to transfer")
+	}
+	coins, err := getCoins(context.Background(), NewNodeClient(conf.Servers[0]), chain, hex.EncodeToString(user))
+	if err != nil {
+		return nil, fmt.Errorf("fail to get balance: %v", err)
+	}
+	// the energy is paid from the balance too
+	if coins < value+txEnergy {
+		return nil, fmt.Errorf("balance %.3f govm is lower than %.3f govm plus the energy %.3f govm",
+			toGovm(coins), toGovm(value), toGovm(txEnergy))
+	}
+	trans := NewTransaction(chain, user)
+	trans.CreateTransfer(payee, value)
+	return trans, nil
+}
+
+// sendTransfer sign and send the transfer from the mining wallet
+func sendTransfer(chain uint64, payee Address, value uint64) ([]byte, error) {
+	trans, err := buildTransfer(chain, userAddress, payee, value)
+	if err != nil {
+		return nil, err
+	}
+	if err = trans.SetSign(userKey, wal.SignPrefix); err != nil {
+		return nil, err
+	}
+	data, key := trans.Output()
+	if err = broadcastTransaction(chain, data); err != nil {
+		return nil, fmt.Errorf("fail to send the transfer: %v", err)
+	}
+	return key, nil
+}
+
+// waitTransaction poll the servers until one of them has the transaction in a block,
+// return the index of the block
+func waitTransaction(chain uint64, key []byte, wait time.Duration) (uint64, error) {
+	deadline := time.Now().Add(wait)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		time.Sleep(5 * time.Second)
+		for _, server := range conf.Servers {
+			info, err := NewNodeClient(server).TransactionInfo(context.Background(), chain, key)
+			if err == nil && info.BlockID() > 0 {
+				return info.BlockID(), nil
+			}
+			if err != nil && err != ErrNotFound {
+				lastErr = err
+			}
+		}
+	}
+	if lastErr != nil {
+		return 0, fmt.Errorf("not confirmed within %s, last error: %v", wait, lastErr)
+	}
+	return 0, fmt.Errorf("not confirmed within %s", wait)
+}
+
+// cmdTransfer transfer govm from the mining wallet, return the exit code
+func cmdTransfer(args []string) int {
+	fs := flag.NewFlagSet("transfer", flag.ExitOnError)
+	chain := fs.Uint64("chain", 0, "chain of the transfer, default the first of chains")
+	to := fs.String("to", "", "address (hex) of the payee")
+	amount := fs.Float64("amount", 0, "govm to transfer")
+	wait := fs.Duration("wait", 30*time.Minute, "how long to wait for the confirmation")
+	fs.Parse(args)
+	if *chain == 0 {
+		*chain = defaultChain()
+	}
+	payee, err := parseAddress(*to)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	key, err := sendTransfer(*chain, payee, fromGovm(*amount))
+	if err != nil {
+		fmt.Printf("chain:%d, %v\n", *chain, err)
+		return 1
+	}
+	fmt.Printf("chain:%d, transfer of %.3f govm to %s sent, transaction:%x\n", *chain, *amount, *to, key)
+	index, err := waitTransaction(*chain, key, *wait)
+	if err != nil {
+		fmt.Printf("chain:%d, transaction:%x %v\n", *chain, key, err)
+		return 1
+	}
+	fmt.Printf("chain:%d, transaction:%x confirmed in block %d\n", *chain, key, index)
+	return 0
+}
+
+// menuTransfer ask for the transfer, send it and track it in the background
+func menuTransfer() {
+	var chain uint64
+	var to, confirm string
+	var amount float64
+	fmt.Print("chain, 0 for the first of chains:")
+	fmt.Scanln(&chain)
+	fmt.Print("payee address:")
+	fmt.Scanln(&to)
+	fmt.Print("govm to transfer:")
+	fmt.Scanln(&amount)
+	if chain == 0 {
+		chain = defaultChain()
+	}
+	payee, err := parseAddress(to)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("transfer %.3f govm to %s on chain %d? (y/n):", amount, to, chain)
+	fmt.Scanln(&confirm)
+	if confirm != "y" {
+		fmt.Println("canceled")
+		return
+	}
+	key, err := sendTransfer(chain, payee, fromGovm(amount))
+	if err != nil {
+		fmt.Printf("chain:%d, %v\n", chain, err)
+		return
+	}
+	fmt.Printf("chain:%d, transfer sent, transaction:%x\n", chain, key)
+	go func() {
+		index, err := waitTransaction(chain, key, 30*time.Minute)
+		if err != nil {
+			fmt.Printf("chain:%d, transaction:%x %v\n", chain, key, err)
+			return
+		}
+		fmt.Printf("chain:%d, transaction:%x confirmed in block %d\n", chain, key, index)
+	}()
+}
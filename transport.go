@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// TLSConfig certificates used to talk to servers behind TLS
+type TLSConfig struct {
+	CAFile             string `json:"ca_file,omitempty"`
+	CertFile           string `json:"cert_file,omitempty"`
+	KeyFile            string `json:"key_file,omitempty"`
+	ServerName         string `json:"server_name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+var tlsConfig = new(tls.Config)
+
+// setupTransport build the TLS config and check the proxies of conf
+func setupTransport() error {
+	cfg := &tls.Config{
+		ServerName:         conf.TLS.ServerName,
+		InsecureSkipVerify: conf.TLS.InsecureSkipVerify,
+	}
+	if conf.TLS.CAFile != "" {
+		pem, err := ioutil.ReadFile(conf.TLS.CAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", conf.TLS.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if conf.TLS.CertFile != "" || conf.TLS.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.TLS.CertFile, conf.TLS.KeyFile)
+		if err != nil {
+			return err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	tlsConfig = cfg
+	return checkProxies()
+}
+
+// serverURL base url of a server entry. An entry without scheme is plain http,
+// ws and wss are the same as http and https.
+func serverURL(server string) (*url.URL, error) {
+	if !strings.Contains(server, "://") {
+		server = "http://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "http"
+	case "https", "wss":
+		u.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("unsupported scheme of server %s", server)
+	}
+	if u.Host == "" {
+		return nil, errors.New("no host in server " + server)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u, nil
+}
+
+// apiURL http(s) url of the path on the server
+func apiURL(server, path string) string {
+	u, err := serverURL(server)
+	if err != nil {
+		return "http://" + server + path
+	}
+	return u.String() + path
+}
+
+// serverTLS the TLS config for a connection to the host, nil for plain connections
+func serverTLS(u *url.URL) *tls.Config {
+	if u.Scheme != "https" {
+		return nil
+	}
+	cfg := tlsConfig.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+	return cfg
+}
+
+// hostPort host of the url with the default port of its scheme
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
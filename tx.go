@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/lengzhao/govm/wallet"
+)
+
+// operations of govm transactions
+const (
+	OpsTransfer = uint8(iota)
+	OpsMove
+	OpsNewChain
+	OpsNewApp
+	OpsRunApp
+	OpsUpdateAppLife
+	OpsRegisterMiner
+)
+
+// StatGuerdon the key of the guerdon in dbStat
+const StatGuerdon = uint8(2)
+
+// TransactionHead transaction = sign + head + data
+type TransactionHead struct {
+	Time   uint64
+	User   Address
+	Chain  uint64
+	Energy uint64
+	Cost   uint64
+	Ops    uint8
+}
+
+// RegMiner info of register miner
+type RegMiner struct {
+	Chain uint64
+	Index uint64
+}
+
+// Transaction a govm transaction, built like core.StTrans
+type Transaction struct {
+	TransactionHead
+	Sign []byte
+	Data []byte
+}
+
+// txEnergy the energy of every transaction, paid from the balance on top of the cost
+const txEnergy = 10000000
+
+// NewTransaction new transaction of the user on the chain
+func NewTransaction(chain uint64, user []byte) *Transaction {
+	t := new(Transaction)
+	t.Chain = chain
+	copy(t.User[:], user)
+	// like core, 10 minutes back so that nodes with a slow clock take it
+	t.Time = uint64(nodeNow().Unix()*1000) - 10*60*1000
+	t.Energy = txEnergy
+	return t
+}
+
+// CreateTransfer transfer value to the payee
+func (t *Transaction) CreateTransfer(payee Address, value uint64) {
+	t.Cost = value
+	t.Ops = OpsTransfer
+	t.Data = payee[:]
+}
+
+// CreateRegisterMiner register the user as a miner of the index on the chain, 0 means t.Chain
+func (t *Transaction) CreateRegisterMiner(chain, index, cost uint64) {
+	t.Cost = cost
+	t.Ops = OpsRegisterMiner
+	t.Data = Encode(RegMiner{chain, index})
+}
+
+// SignData the data to sign
+func (t *Transaction) SignData() []byte {
+	return append(Encode(t.TransactionHead), t.Data...)
+}
+
+// SetSign sign the transaction with the private key, prefix is the SignPrefix of the wallet
+func (t *Transaction) SetSign(privKey, prefix []byte) error {
+	sign := Sign(privKey, t.SignData())
+	if len(sign) == 0 {
+		return errors.New("fail to sign the transaction")
+	}
+	t.Sign = append(append([]byte{}, prefix...), sign...)
+	return nil
+}
+
+// Output the data to send to the node and its key
+func (t *Transaction) Output() ([]byte, []byte) {
+	out := []byte{uint8(len(t.Sign))}
+	out = append(out, t.Sign...)
+	out = append(out, t.SignData()...)
+	return out, wallet.GetHash(out)
+}
+
+// getGuerdon the guerdon of the chain, miners register with 3 times of it
+func getGuerdon(ctx context.Context, c *NodeClient, chain uint64) (uint64, error) {
+	var guerdon Stat
+	if err := getCoreData(ctx, c, chain, "dbStat", fmt.Sprintf("%02x", StatGuerdon), &guerdon); err != nil {
+		return 0, err
+	}
+	return guerdon.Value, nil
+}
+
+// getCoins the balance of the address (hex) on the chain
+func getCoins(ctx context.Context, c *NodeClient, chain uint64, addr string) (uint64, error) {
+	var coins Coins
+	err := getCoreData(ctx, c, chain, "dbCoin", addr, &coins)
+	if err == ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return coins.Balance, nil
+}
+
+// broadcastTransaction send the transaction to all servers, it is enough that one takes it
+func broadcastTransaction(chain uint64, data []byte) error {
+	errs := make(chan error, len(conf.Servers))
+	for _, server := range conf.Servers {
+		go func(s string) {
+			errs <- NewNodeClient(s).NewTransaction(context.Background(), chain, data)
+		}(server)
+	}
+	var firstErr error
+	accepted := 0
+	for range conf.Servers {
+		if err := <-errs; err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			accepted++
+		}
+	}
+	if accepted == 0 {
+		return firstErr
+	}
+	if firstErr != nil && conf.Verbosity >= 3 {
+		fmt.Println("some servers refused the transaction:", firstErr)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lengzhao/govm/wallet"
+	"golang.org/x/net/websocket"
+)
+
+// WorkerConfig the worker side of a mining pool. The wallet only identifies
+// the worker to the coordinator, the payout wallet stays on the coordinator.
+type WorkerConfig struct {
+	Coordinator string `json:"coordinator,omitempty"`
+	WalletFile  string `json:"wallet_file,omitempty"`
+	Password    string `json:"password,omitempty"`
+	// Insecure allow a coordinator without TLS, the signing key comes in plaintext
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+// workerState the job of a worker and what is left of its nonce range
+type workerState struct {
+	mu       sync.Mutex
+	job      *poolJob
+	next     uint64
+	end      uint64
+	asked    bool
+	hashes   uint64
+	accepted uint64
+	rejected uint64
+	blocks   uint64
+
+	sendMu sync.Mutex
+	ws     *websocket.Conn
+}
+
+func (w *workerState) send(msg poolMessage) error {
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+	w.ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return websocket.JSON.Send(w.ws, msg)
+}
+
+// take the next count nonces of the range, ask for a new range when it is used up
+func (w *workerState) take(count uint64) (*poolJob, uint64, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.job == nil {
+		return nil, 0, false
+	}
+	if w.end-w.next < count {
+		if !w.asked {
+			w.asked = true
+			go w.send(poolMessage{Type: poolMsgRange})
+		}
+		return nil, 0, false
+	}
+	start := w.next
+	w.next += count
+	return w.job, start, true
+}
+
+func (w *workerState) setJob(job *poolJob) {
+	w.mu.Lock()
+	w.job = job
+	w.next = job.NonceStart
+	w.end = job.NonceStart + job.NonceCount
+	w.asked = false
+	w.mu.Unlock()
+}
+
+// runWorker mine for the coordinator of conf.Worker until the process is stopped
+func runWorker() {
+	if conf.Worker.WalletFile == "" {
+		conf.Worker.WalletFile = "worker.key"
+	}
+	loadWallet(conf.Worker.WalletFile, conf.Worker.Password, false)
+	fmt.Printf("worker address, add it to pool.workers of the coordinator: %s\n", hex.EncodeToString(wal.Address))
+
+	var attempt uint
+	for {
+		connected, err := workerSession(wal.Address, wal.Key)
+		if connected {
+			attempt = 0
+		}
+		log.Println("disconnected from coordinator,", err)
+		time.Sleep(backoff(attempt))
+		attempt++
+	}
+}
+
+func workerSession(addr, key []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.RequestTimeoutSec)*time.Second)
+	ws, _, err := dialWebsocket(ctx, conf.Worker.Coordinator, poolPath)
+	cancel()
+	if err != nil {
+		return false, err
+	}
+	defer ws.Close()
+
+	head := poolHead{}
+	copy(head.Addr[:], addr)
+	head.Time = time.Now().Unix()
+	data := Encode(head)
+	data = append(data, wallet.Sign(key, data)...)
+	if _, err = ws.Write(data); err != nil {
+		return false, err
+	}
+
+	w := &workerState{ws: ws}
+	done := make(chan struct{})
+	defer close(done)
+	for i := 0; i < conf.ThreadNumber; i++ {
+		go w.mine(i, done)
+	}
+	go w.report(done)
+
+	var connected bool
+	for {
+		var msg poolMessage
+		ws.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		if err = websocket.JSON.Receive(ws, &msg); err != nil {
+			return connected, err
+		}
+		switch msg.Type {
+		case poolMsgJob:
+			if msg.Job == nil {
+				continue
+			}
+			if !connected {
+				connected = true
+				fmt.Println("connected to coordinator:", conf.Worker.Coordinator)
+			}
+			w.setJob(msg.Job)
+			if conf.Verbosity >= 4 {
+				log.Printf("pool job:%d chain:%d index:%d hpl:%d share:%d\n",
+					msg.Job.ID, msg.Job.Block.Chain, msg.Job.Block.Index, msg.Job.HashpowerLimit, msg.Job.ShareHashPower)
+			}
+		case poolMsgResult:
+			if msg.Result == nil {
+				continue
+			}
+			if msg.Result.Accepted {
+				atomic.AddUint64(&w.accepted, 1)
+			} else {
+				atomic.AddUint64(&w.rejected, 1)
+				log.Printf("share rejected, job:%d nonce:%d %s\n", msg.Result.JobID, msg.Result.Nonce, msg.Result.Reason)
+			}
+			if msg.Result.Block {
+				atomic.AddUint64(&w.blocks, 1)
+				log.Printf("share solved the block of job:%d\n", msg.Result.JobID)
+			}
+		case poolMsgError:
+			return connected, errors.New(msg.Error)
+		}
+	}
+}
+
+// mine run GovmSolveMany over the assigned nonces and send every share
+func (w *workerState) mine(thread int, done chan struct{}) {
+	increment := uint64(256)
+	if conf.ChunkHashes > 0 {
+		increment = uint64(conf.ChunkHashes)
+	}
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		job, start, ok := w.take(increment)
+		if !ok {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if conf.Sleep > 0 {
+			time.Sleep(time.Millisecond * time.Duration(conf.Sleep))
+		}
+		block := job.Block
+		block.Nonce = start
+		_, key, nonce := GovmSolveMany(secp256k1_Context, Encode(block), job.Key, increment)
+		atomic.AddUint64(&w.hashes, increment)
+		if getHashPower(key) < job.ShareHashPower {
+			continue
+		}
+		if conf.Verbosity >= 4 {
+			log.Printf("share thread:%d job:%d nonce:%d key:%x\n", thread, job.ID, nonce, key)
+		}
+		share := &poolShare{JobID: job.ID, Nonce: nonce, RangeStart: job.NonceStart, RangeCount: job.NonceCount}
+		w.send(poolMessage{Type: poolMsgShare, Share: share})
+	}
+}
+
+// report send the hashrate to the coordinator every half minute
+func (w *workerState) report(done chan struct{}) {
+	const interval = 30 * time.Second
+	// spread the reports of many workers
+	time.Sleep(time.Duration(rand.Int63n(int64(interval))))
+	last := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+		hashes := atomic.SwapUint64(&w.hashes, 0)
+		rate := uint64(float64(hashes) / time.Since(last).Seconds())
+		last = time.Now()
+		w.send(poolMessage{Type: poolMsgHashrate, Hashrate: rate})
+		if conf.Verbosity >= 3 {
+			log.Printf("worker hashrate=%d accepted=%d rejected=%d blocks=%d\n", rate,
+				atomic.LoadUint64(&w.accepted), atomic.LoadUint64(&w.rejected), atomic.LoadUint64(&w.blocks))
+		}
+	}
+}